@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/chaordic-io/gbuild/internal"
+	"github.com/chaordic-io/gbuild/pkg/api"
+)
+
+const cacheUsage = `Usage: gbuild cache <command> [options]
+
+Commands:
+  ls [target]         List cache entries
+  show <hash>         Show the details of a cache entry
+  stats               Show cache statistics per target
+  rm <target|hash>    Remove the cache entries of a target, or a single entry
+  gc                  Evict least recently used cache entries
+`
+
+func runCacheCommand(args []string, log internal.Log) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, cacheUsage)
+		return 1
+	}
+	switch args[0] {
+	case "ls":
+		return cacheLs(args[1:], log)
+	case "show":
+		return cacheShow(args[1:], log)
+	case "stats":
+		return cacheStats(args[1:], log)
+	case "rm":
+		return cacheRm(args[1:], log)
+	case "gc":
+		return cacheGC(args[1:], log)
+	default:
+		log.Error("Unknown cache command", internal.F("command", args[0]))
+		fmt.Fprint(os.Stderr, cacheUsage)
+		return 1
+	}
+}
+
+func parseCacheFlags(name string, args []string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet("cache "+name, flag.ExitOnError)
+	fileName := flags.String("f", ".gbuild.yaml", "File to read the cache config from")
+	flags.Parse(args)
+	return flags, fileName
+}
+
+func loadConfig(fileName string, log internal.Log) (*internal.Config, bool) {
+	conf, err := internal.LoadConfig(fileName, log)
+	if err != nil {
+		log.Error("Could not read config file, exiting", internal.F("file", fileName), internal.F("error", err))
+		return nil, false
+	}
+	return conf, true
+}
+
+func loadIndex(fileName string, log internal.Log) (api.CacheProvider, *api.CacheIndex, bool) {
+	conf, ok := loadConfig(fileName, log)
+	if !ok {
+		return nil, nil, false
+	}
+	provider := internal.NewCacheProvider(conf.Cache)
+	if provider == nil {
+		log.Error("No cache is configured", internal.F("file", fileName))
+		return nil, nil, false
+	}
+	index, err := provider.GetIndex()
+	if err != nil {
+		log.Error("Failed to get cache index", internal.F("error", err))
+		return nil, nil, false
+	}
+	// entries written before entries were described in the index only have a hash
+	for _, hashes := range []map[string]string{index.Hashes, index.GitHashes} {
+		for _, hash := range hashes {
+			if _, hasKey := index.Entries[hash]; !hasKey {
+				index.Entries[hash] = api.CacheEntry{}
+			}
+		}
+	}
+	return provider, index, true
+}
+
+func sortedHashes(index *api.CacheIndex) []string {
+	var hashes []string
+	for hash := range index.Entries {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		a, b := index.Entries[hashes[i]], index.Entries[hashes[j]]
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		return a.Created.After(b.Created)
+	})
+	return hashes
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func age(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return internal.FormatAge(time.Since(t))
+}
+
+func cacheLs(args []string, log internal.Log) int {
+	flags, fileName := parseCacheFlags("ls", args)
+	target := flags.Arg(0)
+	_, index, ok := loadIndex(*fileName, log)
+	if !ok {
+		return 1
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HASH\tTARGET\tINPUTS\tSIZE\tAGE\tHITS")
+	for _, hash := range sortedHashes(index) {
+		entry := index.Entries[hash]
+		if target != "" && entry.Target != target {
+			continue
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", hash, orUnknown(entry.Target), orUnknown(strings.Join(entry.Inputs, ",")),
+			internal.FormatSize(entry.Size), age(entry.Created), entry.Hits)
+	}
+	w.Flush()
+	return 0
+}
+
+func cacheShow(args []string, log internal.Log) int {
+	flags, fileName := parseCacheFlags("show", args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gbuild cache show <hash>")
+		return 1
+	}
+	provider, index, ok := loadIndex(*fileName, log)
+	if !ok {
+		return 1
+	}
+	// allow unambiguous prefixes of hashes
+	var matches []string
+	for hash := range index.Entries {
+		if strings.HasPrefix(hash, flags.Arg(0)) {
+			matches = append(matches, hash)
+		}
+	}
+	if len(matches) != 1 {
+		log.Error("Expected 1 cache entry matching the hash", internal.F("hash", flags.Arg(0)), internal.F("matches", len(matches)))
+		return 1
+	}
+	hash := matches[0]
+	entry := index.Entries[hash]
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Hash:\t%v\n", hash)
+	fmt.Fprintf(w, "Target:\t%v\n", orUnknown(entry.Target))
+	fmt.Fprintf(w, "Inputs:\t%v\n", orUnknown(strings.Join(entry.Inputs, ", ")))
+	fmt.Fprintf(w, "Size:\t%v\n", internal.FormatSize(entry.Size))
+	fmt.Fprintf(w, "Age:\t%v\n", age(entry.Created))
+	fmt.Fprintf(w, "Hits:\t%v\n", entry.Hits)
+	if entry.LastHit != nil {
+		fmt.Fprintf(w, "Last hit:\t%v ago\n", age(*entry.LastHit))
+	}
+	for key, value := range index.Hashes {
+		if value == hash {
+			fmt.Fprintf(w, "Input hash:\t%v\n", key)
+		}
+	}
+	for key, value := range index.GitHashes {
+		if value == hash {
+			fmt.Fprintf(w, "Git revision:\t%v\n", key)
+		}
+	}
+	w.Flush()
+
+	// list the files of content-addressed entries
+	reader, err := provider.GetCache(hash)
+	manifest := api.Manifest{}
+	if err == nil && json.NewDecoder(*reader).Decode(&manifest) == nil && len(manifest.Files) > 0 {
+		var paths []string
+		for path := range manifest.Files {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		fmt.Printf("\nFiles:\n")
+		for _, path := range paths {
+			fmt.Printf("  %v  %v\n", manifest.Files[path], path)
+		}
+	}
+	return 0
+}
+
+func cacheStats(args []string, log internal.Log) int {
+	_, fileName := parseCacheFlags("stats", args)
+	_, index, ok := loadIndex(*fileName, log)
+	if !ok {
+		return 1
+	}
+	type stats struct {
+		entries int
+		size    int64
+		hits    int
+	}
+	total := stats{}
+	perTarget := map[string]*stats{}
+	var targets []string
+	for _, entry := range index.Entries {
+		name := orUnknown(entry.Target)
+		if perTarget[name] == nil {
+			perTarget[name] = &stats{}
+			targets = append(targets, name)
+		}
+		for _, s := range []*stats{&total, perTarget[name]} {
+			s.entries++
+			s.size += entry.Size
+			s.hits += entry.Hits
+		}
+	}
+	sort.Strings(targets)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tENTRIES\tSIZE\tHITS")
+	for _, name := range targets {
+		s := perTarget[name]
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", name, s.entries, internal.FormatSize(s.size), s.hits)
+	}
+	fmt.Fprintf(w, "Total\t%v\t%v\t%v\n", total.entries, internal.FormatSize(total.size), total.hits)
+	w.Flush()
+	return 0
+}
+
+func cacheRm(args []string, log internal.Log) int {
+	flags, fileName := parseCacheFlags("rm", args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gbuild cache rm <target|hash>")
+		return 1
+	}
+	conf, ok := loadConfig(*fileName, log)
+	if !ok {
+		return 1
+	}
+	provider := internal.NewCacheProvider(conf.Cache)
+	if provider == nil {
+		log.Error("No cache is configured", internal.F("file", *fileName))
+		return 1
+	}
+	removed, err := internal.RemoveCacheEntries(provider, flags.Arg(0))
+	if err != nil {
+		log.Error("Failed to remove cache entries", internal.F("error", err))
+		return 1
+	}
+	log.Info("Removed cache entries", internal.F("target", flags.Arg(0)), internal.F("entries", removed))
+	return 0
+}
+
+func cacheGC(args []string, log internal.Log) int {
+	flags := flag.NewFlagSet("cache gc", flag.ExitOnError)
+	fileName := flags.String("f", ".gbuild.yaml", "File to read the cache config from")
+	maxSizeFlag := flags.String("max-size", "", "Evict least recently used entries beyond this size, e.g. 20GB")
+	maxAgeFlag := flags.String("max-age", "", "Evict entries not accessed for longer than this, e.g. 14d")
+	flags.Parse(args)
+
+	conf, ok := loadConfig(*fileName, log)
+	if !ok {
+		return 1
+	}
+	maxSize, maxAge, err := internal.GCLimits(conf.Cache)
+	if err == nil && *maxSizeFlag != "" {
+		maxSize, err = internal.ParseSize(*maxSizeFlag)
+	}
+	if err == nil && *maxAgeFlag != "" {
+		maxAge, err = internal.ParseAge(*maxAgeFlag)
+	}
+	if err != nil {
+		log.Error("Invalid cache limits", internal.F("error", err))
+		return 1
+	}
+	if maxSize <= 0 && maxAge <= 0 {
+		log.Error("No --max-size or --max-age given, and none configured, nothing to do")
+		return 1
+	}
+
+	res, err := internal.CollectGarbage(nil, internal.NewCacheProvider(conf.Cache), maxSize, maxAge)
+	if err != nil {
+		log.Error("Failed to collect cache garbage", internal.F("error", err))
+		return 1
+	}
+	log.Info("Evicted cache entries", internal.F("entries", res.Removed), internal.F("freed", internal.FormatSize(res.FreedBytes)))
+	return 0
+}
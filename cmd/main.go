@@ -2,7 +2,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/chaordic-io/gbuild/internal"
@@ -11,50 +15,230 @@ import (
 var target string
 var fileName string
 var version bool
+var cacheMode string
+var output string
+var verbose bool
+var quiet bool
+var logFormat string
+var logFile string
+var reportFile string
+var junitFile string
+var traceFile string
+var since string
 
 func init() {
 	flag.StringVar(&target, "t", "build", "Define target execution plan")
 	flag.StringVar(&fileName, "f", ".gbuild.yaml", "File to run")
-	flag.BoolVar(&version, "v", false, "Print the installed gbuild version")
+	flag.BoolVar(&version, "version", false, "Print the installed gbuild version")
+	flag.BoolVar(&verbose, "v", false, "Verbose, log debug messages")
+	flag.BoolVar(&quiet, "q", false, "Quiet, only log warnings and errors")
+	flag.StringVar(&logFormat, "log-format", internal.LogText, "Log format: text or json")
+	flag.StringVar(&logFile, "log-file", "", "File to write the log to, in addition to stdout")
+	flag.StringVar(&cacheMode, "cache", "", "Cache mode: readwrite, read, write or off, defaults to the cache_mode of the plan")
+	flag.StringVar(&reportFile, "report", "", "File to write a JSON report of the run to")
+	flag.StringVar(&junitFile, "junit", "", "File to write a JUnit XML report of the run to, with a test case per target")
+	flag.StringVar(&traceFile, "trace", "", "File to write a trace of the run to, in Chrome Trace Event format")
+	flag.StringVar(&since, "since", "HEAD~1", "Git revision the changed() function of when conditions compares to, along with uncommitted changes, "+
+		"such as the target branch of a pull request, as HEAD~1 only covers the last commit")
+	flag.StringVar(&output, "output", "", "Output mode: live shows the state of each target in place, interleaved prints lines as they come, prefixed by target, "+
+		"grouped prints the output of each target when it finishes, defaults to live on terminals and interleaved otherwise")
 }
 
 func main() {
 	start := time.Now()
 	log := internal.OSLog{}
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		os.Exit(runCacheCommand(os.Args[2:], log))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "watch" {
+		os.Exit(runWatchCommand(os.Args[2:], log))
+	}
 	flag.Parse()
 	if version {
 		internal.PrintVersionInfo()
 		os.Exit(0)
 	}
-	log.Printf("Running target execution plan '%v' on file %v..\n\n", target, fileName)
+	if verbose {
+		log.Level = internal.LevelDebug
+	} else if quiet {
+		log.Level = internal.LevelWarn
+	}
+	if logFormat != internal.LogText && logFormat != internal.LogJSON {
+		log.Error("Invalid log format, must be text or json, exiting", internal.F("format", logFormat))
+		os.Exit(1)
+	}
+	log.Format = logFormat
+	if logFile != "" {
+		file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Error("Could not open log file, exiting", internal.F("file", logFile), internal.F("error", err))
+			os.Exit(1)
+		}
+		defer file.Close()
+		log.File = file
+	}
+	if output == "" {
+		output = internal.DefaultOutput()
+		// json logs are for machines, which have no use for a live display
+		if logFormat == internal.LogJSON {
+			output = internal.OutputInterleaved
+		}
+	}
+	if output != internal.OutputLive && output != internal.OutputInterleaved && output != internal.OutputGrouped {
+		log.Error("Invalid output mode, must be live, interleaved or grouped, exiting", internal.F("output", output))
+		os.Exit(1)
+	}
+	log.Info("Running target execution plan", internal.F("plan", target), internal.F("file", fileName))
 	conf, err := internal.LoadConfig(fileName, log)
 	if err != nil {
-		log.Printf("Could not read config file %v, reason: %v exiting\n\n", fileName, err.Error())
+		log.Error("Could not read config file, exiting", internal.F("file", fileName), internal.F("error", err))
 		os.Exit(1)
 	}
 	targets, err := internal.GetTargetsForPlan(conf, target, log)
 	if err != nil {
-		log.Printf("Could not get targets for %v, reason: %v exiting\n\n", target, err.Error())
+		log.Error("Could not get targets for plan, exiting", internal.F("plan", target), internal.F("error", err))
 		os.Exit(1)
 	}
 
-	err = internal.LoadCache(nil, &targets, nil)
+	unmet, err := internal.ConditionsUnmet(targets, internal.NewWhenContext(target, since, log))
+	if err != nil {
+		log.Error("Could not evaluate when conditions, exiting", internal.F("error", err))
+		os.Exit(1)
+	}
+
+	planHooks, err := internal.GetPlanHooks(conf, target)
+	if err != nil {
+		log.Error("Could not get hooks for plan, exiting", internal.F("plan", target), internal.F("error", err))
+		os.Exit(1)
+	}
+
+	mode, err := internal.CacheModeForPlan(conf, target, cacheMode)
+	if err != nil {
+		log.Error("Invalid cache mode, exiting", internal.F("error", err))
+		os.Exit(1)
+	}
+	if conf.Cache != nil {
+		conf.Cache.Mode = &mode
+	}
+	provider := internal.NewCacheProvider(conf.Cache)
+	// the outputs of targets which are skipped by their when condition are not restored
+	var runnable []internal.Target
+	for _, t := range targets {
+		if !unmet[t.Name] {
+			runnable = append(runnable, t)
+		}
+	}
+	cached, err := internal.LoadCache(nil, &runnable, provider, conf.Cache, log)
 	if err != nil {
-		log.Printf("Failed to get cache, reason: %v\n\n", err.Error())
+		log.Error("Failed to get cache", internal.F("error", err))
 		os.Exit(1)
 	}
 
-	_, err = internal.RunPlan(targets, log)
+	// targets run in process groups of their own, which the signals of the terminal do not reach,
+	// so on an interrupt the running targets are cancelled, which kills their process groups
+	var interrupted int32
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-interrupt
+		// a second interrupt stops gbuild right away
+		signal.Stop(interrupt)
+		log.Warn("Interrupted, cancelling running targets", internal.F("signal", sig))
+		atomic.StoreInt32(&interrupted, 1)
+	}()
+	cancelled := func(string) bool {
+		return atomic.LoadInt32(&interrupted) == 1
+	}
+
+	runID := start.Format("20060102-150405.000")
+	logDir := internal.LogDir(nil, runID)
+	options := internal.RunOptions{Output: output, LogDir: &logDir, Cached: cached, Unmet: unmet, PlanHooks: planHooks, Cancelled: cancelled}
+	// json logs are parsed line by line, so the output of targets goes to stderr
+	if logFormat == internal.LogJSON {
+		options.Stdout = os.Stderr
+	}
+	results, err := internal.RunPlanWithOptions(targets, log, options)
+	logSummary(log, results, start)
+	if reportFile != "" {
+		// the report is written for failed runs too, which is when it is needed most
+		revision, _ := internal.GetGitHash(nil)
+		report := internal.NewReport(target, revision, start, time.Since(start), targets, results, err)
+		if reportErr := internal.WriteReport(reportFile, report); reportErr != nil {
+			log.Error("Failed to write report", internal.F("file", reportFile), internal.F("error", reportErr))
+			os.Exit(1)
+		}
+	}
+	if junitFile != "" {
+		if junitErr := internal.WriteJUnit(junitFile, target, start, time.Since(start), targets, results); junitErr != nil {
+			log.Error("Failed to write JUnit report", internal.F("file", junitFile), internal.F("error", junitErr))
+			os.Exit(1)
+		}
+	}
+	// the trace of a failed run has no cache uploads
+	writeTrace := func(uploads map[string]internal.Span) {
+		if traceFile == "" {
+			return
+		}
+		if traceErr := internal.WriteTrace(traceFile, target, start, results, uploads); traceErr != nil {
+			log.Error("Failed to write trace", internal.F("file", traceFile), internal.F("error", traceErr))
+			os.Exit(1)
+		}
+	}
 	if err != nil {
-		log.Printf("Error executing plan, reason: %v\n\n", err.Error())
+		writeTrace(nil)
+		log.Error("Error executing plan", internal.F("plan", target), internal.F("error", err), internal.F("logs", logDir))
 		os.Exit(1)
 	}
 
-	err = internal.PutCache(nil, &targets, nil)
+	// only targets which ran or were restored have outputs to cache, not those which were skipped or allowed to fail
+	var completed []internal.Target
+	outputs := map[string]map[string]string{}
+	for _, result := range results {
+		if result.Status == internal.StatusSuccess || result.Status == internal.StatusCached {
+			completed = append(completed, result.Target)
+			outputs[result.Target.Name] = result.Outputs
+		}
+	}
+	uploads, err := internal.PutCache(nil, &completed, outputs, provider, conf.Cache)
 	if err != nil {
-		log.Printf("Failed to put cache, reason: %v\n\n", err.Error())
+		log.Error("Failed to put cache", internal.F("error", err))
 		os.Exit(1)
 	}
+	writeTrace(uploads)
+
+	maxSize, maxAge, _ := internal.GCLimits(conf.Cache)
+	if maxSize > 0 || maxAge > 0 {
+		// the local working cache is always ours to clean, but the shared cache only if we may write to it
+		gcProvider := provider
+		if !conf.Cache.CanWrite() {
+			gcProvider = nil
+		}
+		res, err := internal.CollectGarbage(nil, gcProvider, maxSize, maxAge)
+		if err != nil {
+			log.Error("Failed to collect cache garbage", internal.F("error", err))
+			os.Exit(1)
+		}
+		if res.Removed > 0 {
+			log.Info("Evicted cache entries", internal.F("entries", res.Removed), internal.F("freed", internal.FormatSize(res.FreedBytes)))
+		}
+	}
 	elapsed := time.Since(start)
-	log.Printf("Build completed successfully after %v\n\n", elapsed)
+	log.Info("Build completed successfully", internal.F("plan", target), internal.F("duration", elapsed))
+}
+
+// logSummary logs the critical path of the run, the parallelism achieved, and the targets which added most to the critical path
+func logSummary(log internal.Log, results []internal.TargetResult, start time.Time) {
+	for _, result := range results {
+		if result.AllowedFailure {
+			log.Warn("Target failed, which it is allowed to", internal.F("target", result.Target.Name), internal.F("error", *result.Err), internal.F("log", result.LogFile))
+		}
+	}
+	summary := internal.Summarize(results, start, time.Since(start))
+	if len(summary.CriticalPath) == 0 {
+		return
+	}
+	log.Info("Run summary", internal.F("critical_path", summary.Path()), internal.F("parallelism", fmt.Sprintf("%.2f", summary.Parallelism)))
+	for _, step := range summary.TopTargets(5) {
+		log.Info("Time on critical path", internal.F("target", step.Target), internal.F("duration", step.Duration))
+	}
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/chaordic-io/gbuild/internal"
+)
+
+func runWatchCommand(args []string, log internal.OSLog) int {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	plan := flags.String("t", "build", "Define target execution plan")
+	fileName := flags.String("f", ".gbuild.yaml", "File to run")
+	output := flags.String("output", "", "Output mode: live, interleaved or grouped, defaults to live on terminals and interleaved otherwise")
+	interval := flags.Duration("interval", 500*time.Millisecond, "How often to check the inputs of the targets for changes")
+	debounce := flags.Duration("debounce", 300*time.Millisecond, "How long the inputs must be unchanged before running the affected targets")
+	flags.Parse(args)
+
+	if *output == "" {
+		*output = internal.DefaultOutput()
+	}
+	if *output != internal.OutputLive && *output != internal.OutputInterleaved && *output != internal.OutputGrouped {
+		log.Error("Invalid output mode, must be live, interleaved or grouped, exiting", internal.F("output", *output))
+		return 1
+	}
+	conf, err := internal.LoadConfig(*fileName, log)
+	if err != nil {
+		log.Error("Could not read config file, exiting", internal.F("file", *fileName), internal.F("error", err))
+		return 1
+	}
+	targets, err := internal.GetTargetsForPlan(conf, *plan, log)
+	if err != nil {
+		log.Error("Could not get targets for plan, exiting", internal.F("plan", *plan), internal.F("error", err))
+		return 1
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+
+	logDir := internal.LogDir(nil, "watch-"+time.Now().Format("20060102-150405.000"))
+	log.Info("Watching target execution plan", internal.F("plan", *plan), internal.F("file", *fileName))
+	options := internal.WatchOptions{
+		RunOptions: internal.RunOptions{Output: *output, LogDir: &logDir},
+		Interval:   *interval,
+		Debounce:   *debounce,
+	}
+	err = internal.Watch(targets, log, options, stop)
+	if err != nil {
+		log.Error("Failed to watch inputs", internal.F("error", err))
+		return 1
+	}
+	return 0
+}
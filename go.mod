@@ -3,6 +3,9 @@ module github.com/chaordic-io/gbuild
 go 1.16
 
 require (
-	github.com/go-git/go-git/v5 v5.3.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	github.com/bmatcuk/doublestar/v4 v4.0.2
+	github.com/go-git/go-git/v5 v5.3.0
+	github.com/joho/godotenv v1.3.0
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -3,12 +3,18 @@ package internal
 import (
 	"archive/zip"
 	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/chaordic-io/gbuild/pkg/api"
 )
@@ -16,9 +22,9 @@ import (
 type CacheState struct {
 	RootDir     *string
 	WorkDir     *string
+	Target      string
 	Cache       Cache
 	InChecksum  string
-	GitRevs     []string
 	OutChecksum *string
 }
 
@@ -38,23 +44,37 @@ type CacheState struct {
 // .gbuild_cache/index/hash
 // .gbuild_cache/index/githash
 
-func calculateCacheState(rootDir *string, target *Target) (*[]CacheState, error) {
+// calculateCacheState derives the input checksums of a target from the git objects of HEAD on clean checkouts,
+// and by hashing the input files otherwise, which give the same checksums for the same files
+func calculateCacheState(rootDir *string, target *Target, clean bool, hasher *Hasher) (*[]CacheState, error) {
 	if target.Caches != nil && len(*target.Caches) > 0 {
 		var caches []CacheState
 		for _, cache := range *target.Caches {
-			gitRevs, err := GetGitHashes(rootDir, target.WorkDir, cache.Inputs)
-			if err != nil {
-				return nil, err
+			var checksum *string
+			var err error
+			if clean {
+				checksum, err = GetGitTreeHash(rootDir, target.WorkDir, cache.Inputs, cache.Exclude, hasher.Algorithm)
+				if err != nil {
+					return nil, err
+				}
 			}
-			checksum, err := CheckSumWithGitIgnoreWithRelative(rootDir, target.WorkDir, cache.Inputs, true)
-			if err != nil {
-				return nil, err
+			if checksum == nil {
+				checksum, err = hasher.GetBlobHash(rootDir, target.WorkDir, cache.Inputs, cache.Exclude)
+				if err != nil {
+					return nil, err
+				}
 			}
-			outSum, err := CheckSumWithGitIgnoreWithRelative(rootDir, target.WorkDir, cache.Outputs, false)
-			if err != nil {
+			// the declared environment of the target is part of its cache key
+			if env := envDigest(target.Env, hasher.Algorithm); env != "" {
+				hash := newHash(hasher.Algorithm)
+				hash.Write([]byte(*checksum + env))
+				checksum = String(hex.EncodeToString(hash.Sum(nil)))
+			}
+			outSum, err := hasher.CheckSumFiles(rootDir, target.WorkDir, cache.Outputs, cache.Exclude, false)
+			if err != nil && !os.IsNotExist(err) {
 				return nil, err
 			}
-			state := CacheState{rootDir, target.WorkDir, cache, *checksum, *gitRevs, outSum}
+			state := CacheState{rootDir, target.WorkDir, target.Name, cache, *checksum, outSum}
 			caches = append(caches, state)
 		}
 		return &caches, nil
@@ -63,11 +83,15 @@ func calculateCacheState(rootDir *string, target *Target) (*[]CacheState, error)
 	return nil, nil
 }
 
-func calculateCacheStates(rootDir *string, targets *[]Target) (*[]CacheState, error) {
+func calculateCacheStates(rootDir *string, targets *[]Target, hasher *Hasher) (*[]CacheState, error) {
 	if targets != nil {
+		hasChanges, err := HasGitChanges(rootDir)
+		if err != nil {
+			return nil, err
+		}
 		var states []CacheState
 		for _, target := range *targets {
-			newStates, err := calculateCacheState(rootDir, &target)
+			newStates, err := calculateCacheState(rootDir, &target, !hasChanges, hasher)
 			if err != nil {
 				return nil, err
 			}
@@ -82,141 +106,450 @@ func calculateCacheStates(rootDir *string, targets *[]Target) (*[]CacheState, er
 }
 
 func getCacheFile(index *api.CacheIndex, state *CacheState) *string {
+	_, result := getCacheKey(index, state)
+	return result
+}
+
+// getCacheKey returns the index key matching the state, its input checksum, along with the cache entry it points to.
+// Entries are only found by the checksum of their inputs, never by git revision, as a revision neither tells targets
+// apart, nor covers uncommitted changes.
+func getCacheKey(index *api.CacheIndex, state *CacheState) (string, *string) {
 	result, hasKey := index.Hashes[state.InChecksum]
 	if !hasKey {
-		for _, hash := range state.GitRevs {
-			result, hasKey = index.GitHashes[hash]
-			if !hasKey {
-				return &result
-			}
-		}
-		return nil
-	} else {
-		return &result
+		return "", nil
 	}
+	return state.InChecksum, &result
 }
 
-func LoadCache(rootDir *string, targets *[]Target, provider api.CacheProvider) error {
-	if provider == nil || targets == nil {
+// A rejection is a cache entry which cannot be trusted, and is treated as a miss
+type rejection struct {
+	reason string
+}
+
+func (r *rejection) Error() string {
+	return r.reason
+}
+
+// NewCacheProvider returns the cache provider described by the config, or nil if caching is not configured
+func NewCacheProvider(config *CacheConfig) api.CacheProvider {
+	if config == nil || config.Directory == nil {
 		return nil
 	}
+	return &api.LocalFileCacheProvider{Directory: prependPath(nil, *config.Directory)}
+}
+
+// A CacheHit records which index key the outputs of a target were found by, and where they were restored from:
+// the workspace if they were already in place, local if unpacked before, or remote if fetched from the provider
+type CacheHit struct {
+	Key    string
+	Source string
+	// When the outputs were looked up and restored
+	Restore Span
+	// Values the target wrote to $GBUILD_OUTPUT when it ran
+	Outputs map[string]string
+}
+
+// Sources of cache hits
+const (
+	CacheSourceWorkspace = "workspace"
+	CacheSourceLocal     = "local"
+	CacheSourceRemote    = "remote"
+)
+
+// LoadCache looks up the outputs of the targets in the cache, restoring them into their work dirs,
+// and returns the targets of which all caches hit, and so do not need to run
+func LoadCache(rootDir *string, targets *[]Target, provider api.CacheProvider, config *CacheConfig, log Log) (map[string]CacheHit, error) {
+	hits := map[string]CacheHit{}
+	if provider == nil || targets == nil || !config.CanRead() {
+		return hits, nil
+	}
+	signer, err := newSigner(config)
+	if err != nil {
+		return nil, err
+	}
 	cacheDir := prependPath(rootDir, filepath.Join(".gbuild_cache", "cache"))
 	zipDir := prependPath(rootDir, filepath.Join(".gbuild_cache", "compressed"))
 	if _, err := os.Stat(cacheDir); os.IsNotExist(err) {
 		os.MkdirAll(cacheDir, os.ModePerm)
 		os.MkdirAll(zipDir, os.ModePerm)
 	}
-	states, err := calculateCacheStates(rootDir, targets)
+	hasher := NewHasher(rootDir, config.hashAlgorithm())
+	states, err := calculateCacheStates(rootDir, targets, hasher)
 	if err != nil || states == nil {
-		return err
+		return hits, err
+	}
+	err = hasher.Save()
+	if err != nil {
+		return nil, err
 	}
 	index, err := provider.GetIndex()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	caches := map[string]int{}
+	found := map[string][]CacheHit{}
 	for _, state := range *states {
-		cache := getCacheFile(index, &state)
-		if cache != nil && *cache != *state.OutChecksum {
+		caches[state.Target]++
+		start := time.Now()
+		key, cache := getCacheKey(index, &state)
+		if cache == nil {
+			log.Debug("Cache miss", F("target", state.Target), F("inputs", state.InChecksum))
+			continue
+		}
+		if signer != nil && !signer.verify(indexMessage(key, *cache), index.Signatures[key]) {
+			log.Warn("Rejected cache entry, the signature of its index entry does not verify", F("target", state.Target), F("entry", *cache))
+			continue
+		}
+		// the outputs of the target end up in the environment of its dependents, so they must be signed too
+		entry := index.Entries[*cache]
+		if signer != nil && len(entry.Outputs) > 0 && !signer.verify(entryMessage(*cache, entry.Digest, entry.Outputs), entry.Signature) {
+			log.Warn("Rejected cache entry, the signature of its outputs does not verify", F("target", state.Target), F("entry", *cache))
+			continue
+		}
+		source := CacheSourceWorkspace
+		if state.OutChecksum == nil || *cache != *state.OutChecksum {
 			// check if we already downloaded the cache here? -
 			// "has built locally with list" to avoid unpacking same cache multiple times
 			hitDir := filepath.Join(cacheDir, *cache)
-			if _, err := os.Stat(hitDir); os.IsNotExist(err) {
-				os.MkdirAll(hitDir, os.ModePerm)
-				reader, err := provider.GetCache(*cache)
-				if err != nil {
-					return err
+			_, err := os.Stat(hitDir)
+			if err == nil {
+				source = CacheSourceLocal
+				touch(hitDir)
+			} else if os.IsNotExist(err) {
+				source = CacheSourceRemote
+				err = restoreCache(rootDir, zipDir, *cache, hitDir, index, provider, config, signer)
+				var rejected *rejection
+				if errors.As(err, &rejected) {
+					log.Warn("Rejected cache entry", F("target", state.Target), F("entry", *cache), F("reason", rejected.reason))
+					continue
 				}
-				target := prependPath(&zipDir, *cache)
-				fo, err := os.Create(target)
 				if err != nil {
-					return err
-				}
-				w := bufio.NewWriter(fo)
-				buf := make([]byte, 1024)
-				r := bufio.NewReader(*reader)
-				for {
-					n, err := r.Read(buf)
-					if err != nil && err != io.EOF {
-						return err
-					}
-					if n == 0 {
-						break
-					}
-					if _, err := w.Write(buf[:n]); err != nil {
-						panic(err)
-					}
+					return nil, err
 				}
-				if err = w.Flush(); err != nil {
-					return err
-				}
-				targetDir := prependPath(&cacheDir, *cache)
-				unzip(target, targetDir)
-				// move files into target locations of state
+			} else {
+				return nil, err
+			}
+			err = restoreOutputs(hitDir, newFileSet(rootDir, state.WorkDir, state.Cache.Outputs, state.Cache.Exclude).base)
+			if err != nil {
+				return nil, err
 			}
+		} else {
+			// the outputs are already in place, but their unpacked copy in the working cache is still in use
+			touch(filepath.Join(cacheDir, *cache))
+		}
+		log.Debug("Cache hit", F("target", state.Target), F("key", key), F("entry", *cache), F("source", source))
+		recordHit(index, *cache)
+		found[state.Target] = append(found[state.Target], CacheHit{key, source, Span{start, time.Now()}, entry.Outputs})
+	}
+	for target, targetHits := range found {
+		if len(targetHits) == caches[target] {
+			hit := targetHits[0]
+			hit.Restore.End = targetHits[len(targetHits)-1].Restore.End
+			hits[target] = hit
 		}
 	}
+	if len(found) > 0 && config.CanWrite() {
+		return hits, provider.PutIndex(*index)
+	}
 
-	return nil
+	return hits, nil
 }
 
-func PutCache(rootDir *string, targets *[]Target, provider api.CacheProvider) error {
-	if targets != nil {
-		states, err := calculateCacheStates(rootDir, targets)
-		if err != nil || states == nil {
+// restoreOutputs copies the files unpacked into hitDir, named relative to the base of their outputs, into base
+func restoreOutputs(hitDir string, base string) error {
+	return filepath.Walk(hitDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
 			return err
 		}
-		index, err := provider.GetIndex()
-		indexSize := len(index.GitHashes) + len(index.Hashes)
+		rel, err := filepath.Rel(hitDir, path)
 		if err != nil {
 			return err
 		}
+		return copyFile(path, filepath.Join(base, rel))
+	})
+}
+
+// restoreCache fetches a cache entry and unpacks it into hitDir, verifying its signature if a signer is given
+func restoreCache(rootDir *string, zipDir string, hash string, hitDir string, index *api.CacheIndex,
+	provider api.CacheProvider, config *CacheConfig, signer signer) error {
+	reader, err := provider.GetCache(hash)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadAll(*reader)
+	if err != nil {
+		return err
+	}
+	if signer != nil && !signer.verify(entryMessage(hash, digest(buf), index.Entries[hash].Outputs), index.Entries[hash].Signature) {
+		return &rejection{"its signature does not verify"}
+	}
+	if config != nil && config.CAS {
+		return loadManifest(rootDir, buf, hitDir, provider)
+	}
+	target := prependPath(&zipDir, hash)
+	err = writeFile(target, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	_, err = unzip(hitDir, target)
+	return err
+}
+
+func recordHit(index *api.CacheIndex, hash string) {
+	if entry, hasKey := index.Entries[hash]; hasKey {
+		now := time.Now()
+		entry.Hits++
+		entry.LastHit = &now
+		index.Entries[hash] = entry
+	}
+}
+
+// PutCache writes the outputs of the targets to the cache, if they are not in it yet, along with the values each target
+// wrote to $GBUILD_OUTPUT, keyed by target, and returns when the outputs of each target written were uploaded
+func PutCache(rootDir *string, targets *[]Target, outputs map[string]map[string]string, provider api.CacheProvider, config *CacheConfig) (map[string]Span, error) {
+	uploads := map[string]Span{}
+	if provider != nil && targets != nil && config.CanWrite() {
+		signer, err := newSigner(config)
+		if err != nil {
+			return nil, err
+		}
+		hasher := NewHasher(rootDir, config.hashAlgorithm())
+		states, err := calculateCacheStates(rootDir, targets, hasher)
+		if err != nil || states == nil {
+			return uploads, err
+		}
+		err = hasher.Save()
+		if err != nil {
+			return nil, err
+		}
+		index, err := provider.GetIndex()
+		if err != nil {
+			return nil, err
+		}
+		// write mode forces a rebuild to repopulate the cache, so it replaces the entries which exist
+		overwrite := config.mode() == CacheWrite
+		written := false
 		for _, state := range *states {
-			if getCacheFile(index, &state) == nil && state.OutChecksum != nil {
-				targetFile := prependPath(rootDir, *state.OutChecksum)
-				err = zipTarget(targetFile, state.Cache.Outputs)
-				if err != nil {
-					return err
-				}
-				file, err := os.Open(targetFile)
-				if err != nil {
-					return err
-				}
-				reader := bufio.NewReader(file)
-				err = provider.PutCache(targetFile, reader)
-				if err != nil {
-					return err
+			if (overwrite || getCacheFile(index, &state) == nil) && state.OutChecksum != nil {
+				start := time.Now()
+				var entry *api.CacheEntry
+				if config != nil && config.CAS {
+					entry, err = putManifest(rootDir, &state, provider, hasher)
+				} else {
+					entry, err = putZip(rootDir, &state, provider)
 				}
-				hasChanges, err := HasGitChanges(rootDir)
 				if err != nil {
-					return err
+					return nil, err
 				}
-				if !hasChanges {
-					gitHash, err := GetGitHash(rootDir)
+				entry.Target = state.Target
+				entry.Inputs = state.Cache.Inputs
+				entry.Created = time.Now()
+				entry.Outputs = outputs[state.Target]
+				if signer != nil {
+					entry.Signature, err = signer.sign(entryMessage(*state.OutChecksum, entry.Digest, entry.Outputs))
 					if err != nil {
-						return err
+						return nil, err
 					}
-					fmt.Println("Add a git hash entry here")
-					index.GitHashes[*gitHash] = *state.OutChecksum
 				}
+				index.Entries[*state.OutChecksum] = *entry
 				index.Hashes[state.InChecksum] = *state.OutChecksum
+				err = signIndexEntry(index, signer, state.InChecksum, *state.OutChecksum)
+				if err != nil {
+					return nil, err
+				}
+				written = true
+				upload, uploaded := uploads[state.Target]
+				if !uploaded {
+					upload.Start = start
+				}
+				upload.End = time.Now()
+				uploads[state.Target] = upload
 			}
 		}
-		newIndexSize := len(index.GitHashes) + len(index.Hashes)
-		if newIndexSize > indexSize {
+		if written {
 			err = provider.PutIndex(*index)
 		}
+		return uploads, err
+	}
+
+	return uploads, nil
+}
+
+func signIndexEntry(index *api.CacheIndex, signer signer, key string, hash string) error {
+	if signer == nil {
+		return nil
+	}
+	signature, err := signer.sign(indexMessage(key, hash))
+	index.Signatures[key] = signature
+	return err
+}
+
+// putZip uploads the outputs of the state as a zip archive, which is written to .gbuild_cache/compressed
+// rather than the project, and removed once uploaded
+func putZip(rootDir *string, state *CacheState, provider api.CacheProvider) (*api.CacheEntry, error) {
+	targetFile := prependPath(rootDir, filepath.Join(".gbuild_cache", "compressed", *state.OutChecksum))
+	err := os.MkdirAll(filepath.Dir(targetFile), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(targetFile)
+	err = zipTarget(targetFile, newFileSet(rootDir, state.WorkDir, state.Cache.Outputs, state.Cache.Exclude))
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(targetFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	reader := io.TeeReader(bufio.NewReader(file), hash)
+	err = provider.PutCache(*state.OutChecksum, reader)
+	if err != nil {
+		return nil, err
+	}
+	return &api.CacheEntry{Size: info.Size(), Digest: hex.EncodeToString(hash.Sum(nil)), Format: api.FormatZip}, nil
+}
+
+// putManifest uploads every output file of the state that the provider does not already have
+// as a blob, followed by a manifest mapping the output paths to their blobs.
+func putManifest(rootDir *string, state *CacheState, provider api.CacheProvider, hasher *Hasher) (*api.CacheEntry, error) {
+	blobs, ok := provider.(api.BlobProvider)
+	if !ok {
+		return nil, errors.New("the configured cache provider does not support content-addressed storage")
+	}
+	set := newFileSet(rootDir, state.WorkDir, state.Cache.Outputs, state.Cache.Exclude)
+	manifest := api.Manifest{Files: map[string]string{}, Algorithm: hasher.Algorithm}
+	size := int64(0)
+	err := set.walk(func(string) bool { return false }, func(path string, rel string) error {
+		sum, err := hasher.sumFile(path)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		blob := hex.EncodeToString(sum)
+		manifest.Files[rel] = blob
+		hasBlob, err := blobs.HasBlob(blob)
+		if err != nil || hasBlob {
+			return err
+		}
+		return putBlob(blobs, blob, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	err = provider.PutCache(*state.OutChecksum, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	return &api.CacheEntry{Size: size, Digest: digest(buf), Format: api.FormatManifest}, nil
+}
+
+func putBlob(blobs api.BlobProvider, blob string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
 		return err
 	}
+	defer file.Close()
+	return blobs.PutBlob(blob, bufio.NewReader(file))
+}
 
-	return nil
+// loadManifest materializes the files of a manifest into hitDir, only fetching the blobs that
+// are not already in the local blob store, and rejecting blobs whose contents do not match their hash.
+func loadManifest(rootDir *string, buf []byte, hitDir string, provider api.CacheProvider) error {
+	blobs, ok := provider.(api.BlobProvider)
+	if !ok {
+		return errors.New("the configured cache provider does not support content-addressed storage")
+	}
+	manifest := api.Manifest{}
+	err := json.Unmarshal(buf, &manifest)
+	if err != nil {
+		return &rejection{fmt.Sprintf("its manifest is invalid: %v", err)}
+	}
+	algorithm := manifest.Algorithm
+	if algorithm == "" {
+		algorithm = MD5
+	}
+	blobDir := prependPath(rootDir, filepath.Join(".gbuild_cache", "blobs"))
+	// materialize into a temporary dir, so a failed load is not mistaken for a complete one
+	tmpDir := hitDir + ".tmp"
+	os.RemoveAll(tmpDir)
+	for path, blob := range manifest.Files {
+		local := filepath.Join(blobDir, blob)
+		_, err := os.Stat(local)
+		if err == nil {
+			touch(local)
+		} else if os.IsNotExist(err) {
+			blobReader, err := blobs.GetBlob(blob)
+			if err != nil {
+				os.RemoveAll(tmpDir)
+				return &rejection{fmt.Sprintf("blob %v is missing: %v", blob, err)}
+			}
+			contents, err := ioutil.ReadAll(*blobReader)
+			if err != nil {
+				os.RemoveAll(tmpDir)
+				return &rejection{fmt.Sprintf("blob %v is missing: %v", blob, err)}
+			}
+			hash := newHash(algorithm)
+			hash.Write(contents)
+			if hex.EncodeToString(hash.Sum(nil)) != blob {
+				os.RemoveAll(tmpDir)
+				return &rejection{fmt.Sprintf("the contents of blob %v do not match its hash", blob)}
+			}
+			err = writeFile(local, bytes.NewReader(contents))
+			if err != nil {
+				return err
+			}
+		}
+		dest := filepath.Join(tmpDir, filepath.FromSlash(path))
+		if !strings.HasPrefix(dest, filepath.Clean(tmpDir)+string(os.PathSeparator)) {
+			return &rejection{fmt.Sprintf("%s: illegal file path", dest)}
+		}
+		// the local blob may have been evicted since
+		err = copyFile(local, dest)
+		if err != nil {
+			os.RemoveAll(tmpDir)
+			return &rejection{fmt.Sprintf("blob %v is missing: %v", blob, err)}
+		}
+	}
+	return os.Rename(tmpDir, hitDir)
 }
 
-func zipTarget(targetFile string, outputs []string) error {
-	mappings := map[string]string{}
-	for _, v := range outputs {
-		mappings[v] = v
+// zipTarget archives the files of the set, named by their paths relative to the base of the set
+func zipTarget(targetFile string, set fileSet) error {
+	outFile, err := os.Create(targetFile)
+	if err != nil {
+		return err
 	}
-	return zipWriter(targetFile, mappings)
+	defer outFile.Close()
+	w := zip.NewWriter(outFile)
+	defer w.Close()
+
+	return set.walk(func(string) bool { return false }, func(path string, rel string) error {
+		f, err := w.Create(rel)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(f, file)
+		return err
+	})
 }
 
 func unzip(dest string, src string) ([]string, error) {
@@ -325,3 +658,43 @@ func addFiles(w *zip.Writer, basePath, baseInZip string) error {
 	}
 	return nil
 }
+
+// RemoveCacheEntries removes every cache entry that either has the given hash or belongs to the given target,
+// returning the number of entries removed
+func RemoveCacheEntries(provider api.CacheProvider, targetOrHash string) (int, error) {
+	index, err := provider.GetIndex()
+	if err != nil {
+		return 0, err
+	}
+	removed := map[string]bool{}
+	for hash, entry := range index.Entries {
+		if hash == targetOrHash || entry.Target == targetOrHash {
+			removed[hash] = true
+		}
+	}
+	for _, hashes := range []map[string]string{index.Hashes, index.GitHashes} {
+		for key, hash := range hashes {
+			if hash == targetOrHash {
+				removed[hash] = true
+			}
+			if removed[hash] {
+				delete(hashes, key)
+				delete(index.Signatures, key)
+			}
+		}
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	remover, canRemove := provider.(api.CacheRemover)
+	for hash := range removed {
+		delete(index.Entries, hash)
+		if canRemove {
+			err = remover.RemoveCache(hash)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(removed), provider.PutIndex(*index)
+}
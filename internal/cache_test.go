@@ -1,19 +1,27 @@
 package internal
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/chaordic-io/gbuild/pkg/api"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
 func cacheToTarget(caches *[]Cache) Target {
-	return Target{"foo", nil, String("internal"), "bla", nil, caches}
+	return Target{Name: "foo", WorkDir: String("internal"), Run: "bla", Caches: caches}
 }
 func TestCalculateCacheStatesWithOne(t *testing.T) {
 	cache := cacheToTarget(&[]Cache{
-		{[]string{"config.go", "execution.go"}, []string{"config_test.go", "execution_test.go"}},
+		{Inputs: []string{"config.go", "execution.go"}, Outputs: []string{"config_test.go", "execution_test.go"}},
 	})
 
-	state, err := calculateCacheStates(String("../"), &[]Target{cache})
+	state, err := calculateCacheStates(String("../"), &[]Target{cache}, &Hasher{Algorithm: SHA256})
 	if err != nil {
 		t.Fatalf("Did not expect error %v", err)
 	}
@@ -50,4 +58,327 @@ func TestZipUnzip(t *testing.T) {
 
 }
 
+func TestPutLoadContentAddressed(t *testing.T) {
+	root := "../tmp/cas"
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+	os.MkdirAll(filepath.Join(root, "src"), os.ModePerm)
+	os.MkdirAll(filepath.Join(root, "dist", "sub"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(root, "src", "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "dist", "b.txt"), []byte("b"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "dist", "sub", "c.txt"), []byte("b"), 0644)
+
+	targets := []Target{{Name: "foo", Caches: &[]Cache{{Inputs: []string{"src"}, Outputs: []string{"dist"}}}}}
+	provider := &api.LocalFileCacheProvider{Directory: filepath.Join(root, "remote")}
+	config := &CacheConfig{CAS: true}
+
+	outputs := map[string]map[string]string{"foo": {"digest": "sha256:abc"}}
+	uploads, err := PutCache(String(root), &targets, outputs, provider, config)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if uploads["foo"].Start.IsZero() || uploads["foo"].Duration() < 0 {
+		t.Fatalf("Expected the upload of foo to be timed, got %v", uploads)
+	}
+	index, _ := provider.GetIndex()
+	if len(index.Hashes) != 1 {
+		t.Fatalf("Expected 1 index entry, got %v", index.Hashes)
+	}
+	blobs, _ := ioutil.ReadDir(filepath.Join(root, "remote", "blobs"))
+	if len(blobs) != 1 {
+		t.Fatalf("Expected identical files to be stored as 1 blob, got %v", len(blobs))
+	}
+
+	os.RemoveAll(filepath.Join(root, "dist"))
+	hits, err := LoadCache(String(root), &targets, provider, config, NoLog{})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if hits["foo"].Source != CacheSourceRemote || hits["foo"].Outputs["digest"] != "sha256:abc" {
+		t.Fatalf("Expected foo to be restored from the remote cache, along with its outputs, got %v", hits)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(root, "dist", "sub", "c.txt")); err != nil || string(buf) != "b" {
+		t.Fatalf("Expected outputs to be restored into the workspace, got %v, %v", string(buf), err)
+	}
+	index, _ = provider.GetIndex()
+	for _, hash := range index.Hashes {
+		if index.Entries[hash].Target != "foo" || index.Entries[hash].Hits != 1 {
+			t.Fatalf("Expected entry of target foo with 1 hit, got %v", index.Entries[hash])
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(root, ".gbuild_cache", "cache", hash, "dist", "sub", "c.txt"))
+		if err != nil || string(buf) != "b" {
+			t.Fatalf("Expected restored file to contain b, got %v, %v", string(buf), err)
+		}
+	}
+}
+
+func TestMissingBlobIsAMiss(t *testing.T) {
+	root := "../tmp/missing-blob"
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+	os.MkdirAll(filepath.Join(root, "src"), os.ModePerm)
+	os.MkdirAll(filepath.Join(root, "dist"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(root, "src", "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "dist", "b.txt"), []byte("b"), 0644)
+
+	targets := []Target{{Name: "foo", Caches: &[]Cache{{Inputs: []string{"src"}, Outputs: []string{"dist"}}}}}
+	provider := &api.LocalFileCacheProvider{Directory: filepath.Join(root, "remote")}
+	config := &CacheConfig{CAS: true}
+	_, err := PutCache(String(root), &targets, nil, provider, config)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+
+	// the blob is gone from both the remote and the local working cache
+	os.RemoveAll(filepath.Join(root, "remote", "blobs"))
+	os.RemoveAll(filepath.Join(root, ".gbuild_cache"))
+	os.RemoveAll(filepath.Join(root, "dist"))
+	hits, err := LoadCache(String(root), &targets, provider, config, NoLog{})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if _, hit := hits["foo"]; hit {
+		t.Fatalf("Expected foo to miss the cache, as its blob is missing, got %v", hits)
+	}
+}
+
+func TestTamperedSignedCacheIsRejected(t *testing.T) {
+	root := "../tmp/signed"
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+	os.Setenv("GBUILD_TEST_KEY", "secret")
+	defer os.Unsetenv("GBUILD_TEST_KEY")
+	os.MkdirAll(filepath.Join(root, "src"), os.ModePerm)
+	os.MkdirAll(filepath.Join(root, "dist"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(root, "src", "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "dist", "b.txt"), []byte("b"), 0644)
+
+	targets := []Target{{Name: "foo", Caches: &[]Cache{{Inputs: []string{"src"}, Outputs: []string{"dist"}}}}}
+	provider := &api.LocalFileCacheProvider{Directory: filepath.Join(root, "remote")}
+	config := &CacheConfig{CAS: true, Signing: &SigningConfig{KeyEnv: String("GBUILD_TEST_KEY")}}
+
+	_, err := PutCache(String(root), &targets, nil, provider, config)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	index, _ := provider.GetIndex()
+	var hash string
+	for _, h := range index.Hashes {
+		hash = h
+	}
+	os.RemoveAll(filepath.Join(root, "dist"))
+	provider.PutCache(hash, strings.NewReader(`{"Files":{"dist/b.txt":"bad"}}`))
+
+	_, err = LoadCache(String(root), &targets, provider, config, NoLog{})
+	if err != nil {
+		t.Fatalf("Expected tampered entry to be treated as a miss, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".gbuild_cache", "cache", hash)); !os.IsNotExist(err) {
+		t.Fatalf("Expected tampered entry not to be restored, got %v", err)
+	}
+}
+
+func TestReadOnlyCacheIsNotWritten(t *testing.T) {
+	root := "../tmp/readonly"
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+	os.MkdirAll(filepath.Join(root, "src"), os.ModePerm)
+	os.MkdirAll(filepath.Join(root, "dist"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(root, "src", "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "dist", "b.txt"), []byte("b"), 0644)
+
+	targets := []Target{{Name: "foo", Caches: &[]Cache{{Inputs: []string{"src"}, Outputs: []string{"dist"}}}}}
+	provider := &api.LocalFileCacheProvider{Directory: filepath.Join(root, "remote")}
+
+	_, err := PutCache(String(root), &targets, nil, provider, &CacheConfig{CAS: true, Mode: String(CacheRead)})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if _, err := os.Stat(provider.Directory); !os.IsNotExist(err) {
+		t.Fatalf("Expected nothing to be written to a read-only cache, got %v", err)
+	}
+}
+
+func TestWriteModeReplacesEntries(t *testing.T) {
+	root := "../tmp/writemode"
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+	os.MkdirAll(filepath.Join(root, "src"), os.ModePerm)
+	os.MkdirAll(filepath.Join(root, "dist"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(root, "src", "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "dist", "b.txt"), []byte("b"), 0644)
+
+	targets := []Target{{Name: "foo", Caches: &[]Cache{{Inputs: []string{"src"}, Outputs: []string{"dist"}}}}}
+	provider := &api.LocalFileCacheProvider{Directory: filepath.Join(root, "remote")}
+	put := func(mode string, value string) string {
+		outputs := map[string]map[string]string{"foo": {"value": value}}
+		_, err := PutCache(String(root), &targets, outputs, provider, &CacheConfig{CAS: true, Mode: String(mode)})
+		if err != nil {
+			t.Fatalf("Did not expect error %v", err)
+		}
+		index, _ := provider.GetIndex()
+		for _, hash := range index.Hashes {
+			return index.Entries[hash].Outputs["value"]
+		}
+		return ""
+	}
+
+	if value := put(CacheReadWrite, "first"); value != "first" {
+		t.Fatalf("Expected the entry to be written, got %v", value)
+	}
+	if value := put(CacheReadWrite, "second"); value != "first" {
+		t.Fatalf("Expected readwrite mode to keep the existing entry, got %v", value)
+	}
+	if value := put(CacheWrite, "third"); value != "third" {
+		t.Fatalf("Expected write mode to replace the existing entry, got %v", value)
+	}
+}
+
+func TestRemoveCacheEntries(t *testing.T) {
+	provider := &api.LocalFileCacheProvider{Directory: t.TempDir()}
+	provider.PutIndex(api.CacheIndex{
+		Hashes:    map[string]string{"in1": "out1", "in2": "out2", "in3": "out3"},
+		GitHashes: map[string]string{"rev1": "out1"},
+		Entries:   map[string]api.CacheEntry{"out1": {Target: "foo"}, "out2": {Target: "foo"}, "out3": {Target: "bar"}},
+	})
+
+	removed, err := RemoveCacheEntries(provider, "foo")
+	if err != nil || removed != 2 {
+		t.Fatalf("Expected 2 entries removed, got %v, %v", removed, err)
+	}
+	removed, err = RemoveCacheEntries(provider, "out3")
+	if err != nil || removed != 1 {
+		t.Fatalf("Expected 1 entry removed, got %v, %v", removed, err)
+	}
+	index, _ := provider.GetIndex()
+	if len(index.Hashes) != 0 || len(index.GitHashes) != 0 || len(index.Entries) != 0 {
+		t.Fatalf("Expected empty index, got %v", index)
+	}
+}
+
 // test ability to put mix of folders and files back in the right place
+
+func TestCacheEntriesAreKeyedByInputs(t *testing.T) {
+	root := t.TempDir()
+	repo, err := git.PlainInit(root, false)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	for _, dir := range []string{"a", "b"} {
+		os.MkdirAll(filepath.Join(root, dir, "src"), os.ModePerm)
+		os.MkdirAll(filepath.Join(root, dir, "dist"), os.ModePerm)
+		ioutil.WriteFile(filepath.Join(root, dir, "src", "in.txt"), []byte(dir), 0644)
+		ioutil.WriteFile(filepath.Join(root, dir, "dist", "out.txt"), []byte(dir+" built"), 0644)
+	}
+	ioutil.WriteFile(filepath.Join(root, ".gitignore"), []byte("dist/\n.gbuild_cache/\nremote/\n"), 0644)
+	worktree, _ := repo.Worktree()
+	worktree.AddGlob(".")
+	_, err = worktree.Commit("initial", &git.CommitOptions{Author: &object.Signature{Name: "gbuild", When: time.Now()}})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+
+	targets := []Target{
+		{Name: "a", WorkDir: String("a"), Caches: &[]Cache{{Inputs: []string{"src"}, Outputs: []string{"dist"}}}},
+		{Name: "b", WorkDir: String("b"), Caches: &[]Cache{{Inputs: []string{"src"}, Outputs: []string{"dist"}}}},
+	}
+	provider := &api.LocalFileCacheProvider{Directory: filepath.Join(root, "remote")}
+	_, err = PutCache(String(root), &targets, nil, provider, &CacheConfig{CAS: true})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(root, "b", "src", "in.txt"), []byte("b changed"), 0644)
+	os.RemoveAll(filepath.Join(root, "a", "dist"))
+	hits, err := LoadCache(String(root), &targets, provider, &CacheConfig{CAS: true}, NoLog{})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if _, hit := hits["b"]; hit {
+		t.Fatalf("Expected b to miss the cache after its inputs changed, got %v", hits)
+	}
+	// the entry of a was put from a clean checkout, and is found from a dirty one, as the inputs of a are unchanged
+	if _, hit := hits["a"]; !hit {
+		t.Fatalf("Expected a to hit the cache, as its inputs did not change, got %v", hits)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(root, "a", "dist", "out.txt")); err != nil || string(buf) != "a built" {
+		t.Fatalf("Expected a to be restored from its own entry, got %v, %v", string(buf), err)
+	}
+}
+
+func TestPutZipLeavesTheWorktreeClean(t *testing.T) {
+	root := t.TempDir()
+	repo, err := git.PlainInit(root, false)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	os.MkdirAll(filepath.Join(root, "src"), os.ModePerm)
+	os.MkdirAll(filepath.Join(root, "dist"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(root, "src", "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "dist", "b.txt"), []byte("b"), 0644)
+	ioutil.WriteFile(filepath.Join(root, ".gitignore"), []byte("dist/\n.gbuild_cache/\nremote/\n"), 0644)
+	worktree, _ := repo.Worktree()
+	worktree.Add("src/a.txt")
+	worktree.Add(".gitignore")
+	_, err = worktree.Commit("initial", &git.CommitOptions{Author: &object.Signature{Name: "gbuild", When: time.Now()}})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+
+	targets := []Target{{Name: "foo", Caches: &[]Cache{{Inputs: []string{"src"}, Outputs: []string{"dist"}}}}}
+	provider := &api.LocalFileCacheProvider{Directory: filepath.Join(root, "remote")}
+	_, err = PutCache(String(root), &targets, nil, provider, &CacheConfig{})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	index, _ := provider.GetIndex()
+	if len(index.Entries) != 1 {
+		t.Fatalf("Expected 1 cache entry, got %v", index.Entries)
+	}
+	if hasChanges, err := HasGitChanges(String(root)); err != nil || hasChanges {
+		t.Fatalf("Expected putting the cache to leave the worktree clean, got %v, %v", hasChanges, err)
+	}
+	if zips, _ := ioutil.ReadDir(filepath.Join(root, ".gbuild_cache", "compressed")); len(zips) != 0 {
+		t.Fatalf("Expected uploaded zips to be removed, got %v", len(zips))
+	}
+}
+
+func TestTamperedSignedOutputsAreRejected(t *testing.T) {
+	root := "../tmp/signed-outputs"
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+	os.Setenv("GBUILD_TEST_KEY", "secret")
+	defer os.Unsetenv("GBUILD_TEST_KEY")
+	os.MkdirAll(filepath.Join(root, "src"), os.ModePerm)
+	os.MkdirAll(filepath.Join(root, "dist"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(root, "src", "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "dist", "b.txt"), []byte("b"), 0644)
+
+	targets := []Target{{Name: "foo", Caches: &[]Cache{{Inputs: []string{"src"}, Outputs: []string{"dist"}}}}}
+	provider := &api.LocalFileCacheProvider{Directory: filepath.Join(root, "remote")}
+	config := &CacheConfig{CAS: true, Signing: &SigningConfig{KeyEnv: String("GBUILD_TEST_KEY")}}
+
+	outputs := map[string]map[string]string{"foo": {"digest": "sha256:abc"}}
+	_, err := PutCache(String(root), &targets, outputs, provider, config)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	hits, err := LoadCache(String(root), &targets, provider, config, NoLog{})
+	if err != nil || hits["foo"].Outputs["digest"] != "sha256:abc" {
+		t.Fatalf("Expected foo to hit the cache with its outputs, got %v, %v", hits, err)
+	}
+
+	index, _ := provider.GetIndex()
+	for hash, entry := range index.Entries {
+		entry.Outputs["digest"] = "sha256:bad"
+		index.Entries[hash] = entry
+	}
+	provider.PutIndex(*index)
+	hits, err = LoadCache(String(root), &targets, provider, config, NoLog{})
+	if err != nil {
+		t.Fatalf("Expected tampered entry to be treated as a miss, got %v", err)
+	}
+	if _, hit := hits["foo"]; hit {
+		t.Fatalf("Expected tampered outputs to be rejected, got %v", hits)
+	}
+}
@@ -3,13 +3,17 @@ package internal
 import (
 	"fmt"
 	"io/ioutil"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
 
+// Inputs and outputs are paths or doublestar globs relative to the work dir of the target,
+// where patterns starting with ! exclude files, as do the patterns of the exclude list
 type Cache struct {
 	Inputs  []string `yaml:"inputs"`
 	Outputs []string `yaml:"outputs"`
+	Exclude []string `yaml:"exclude"`
 }
 
 type Target struct {
@@ -19,17 +23,169 @@ type Target struct {
 	Run        string    `yaml:"run"`
 	DependsOn  *[]string `yaml:"depends_on"`
 	Caches     *[]Cache  `yaml:"caches"`
+	// Environment variables of the target, taking precedence over those of the plan and the config
+	Env     map[string]string `yaml:"env"`
+	EnvFile *string           `yaml:"env_file"`
+	// Shell to run the run block with, such as bash -euo pipefail, defaulting to the shell of the config
+	Shell *string `yaml:"shell"`
+	// Command to exec directly, without a shell, as an alternative to run
+	Command *[]string `yaml:"command"`
+	// Services run in the background, and satisfy depends_on once their ready check succeeds,
+	// until they are stopped when their dependents have finished
+	Service    bool        `yaml:"service"`
+	ReadyCheck *ReadyCheck `yaml:"ready_check"`
+	Hooks      `yaml:",inline"`
+	// Failures of the target are reported, but do not fail the plan, and its dependents still run
+	AllowFailure *AllowFailure `yaml:"allow_failure"`
+	// Condition the target only runs if, such as branch == "main" && changed("infra/**"), otherwise it is skipped,
+	// still satisfying depends_on
+	When *string `yaml:"when"`
+	// Values to run the target with, such as scala: ["2.12", "2.13"], expanding it into a target per combination
+	// named like Backend[scala=2.13], see expandMatrix
+	Matrix    map[string][]string `yaml:"matrix"`
+	matrixEnv map[string]string
+	// Outputs of the dependencies of the target as GBUILD_DEP_ variables, kept apart from Env,
+	// as they are not part of its cache key
+	dependencyOutputs map[string]string
+}
+
+// AllowFailure is either true, allowing a target to fail with any exit code, or lists the exit_codes it may fail with
+type AllowFailure struct {
+	Enabled   bool
+	ExitCodes []int `yaml:"exit_codes"`
+}
+
+func (allow *AllowFailure) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&allow.Enabled); err == nil {
+		return nil
+	}
+	var codes struct {
+		ExitCodes []int `yaml:"exit_codes"`
+	}
+	if err := unmarshal(&codes); err != nil {
+		return fmt.Errorf("allow_failure must be true, false or have exit_codes: %v", err)
+	}
+	allow.Enabled = true
+	allow.ExitCodes = codes.ExitCodes
+	return nil
+}
+
+// allows tells whether a failure with the exit code is allowed, where a failure without an exit code,
+// such as a missing work dir, is only allowed if no exit codes are listed
+func (allow *AllowFailure) allows(exitCode *int) bool {
+	if allow == nil || !allow.Enabled {
+		return false
+	}
+	if len(allow.ExitCodes) == 0 {
+		return true
+	}
+	for _, code := range allow.ExitCodes {
+		if exitCode != nil && *exitCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Hooks are scripts run after a target or plan has finished, depending on its outcome
+type Hooks struct {
+	OnFailure *string `yaml:"on_failure"`
+	OnSuccess *string `yaml:"on_success"`
+	Always    *string `yaml:"always"`
+}
+
+// ReadyCheck tells when a service is ready, by either a command exiting with 0, a port on localhost accepting
+// TCP connections, or an HTTP URL responding with a 2xx status
+type ReadyCheck struct {
+	Command *string `yaml:"command"`
+	TCP     *int    `yaml:"tcp"`
+	HTTP    *string `yaml:"http"`
+	// How long to wait between checks, 500ms by default
+	Interval *string `yaml:"interval"`
+	// How long to wait for the service to be ready, 60s by default
+	Timeout *string `yaml:"timeout"`
 }
 
 // Add cache provider to this
 type ExecutionPlan struct {
 	Name    string   `yaml:"name"`
 	Targets []string `yaml:"targets"`
+	// Default cache mode for this plan, overriding the mode of the cache config
+	CacheMode *string `yaml:"cache_mode"`
+	// Environment variables of all targets in this plan, taking precedence over those of the config
+	Env     map[string]string `yaml:"env"`
+	EnvFile *string           `yaml:"env_file"`
+	// Scripts run after all targets of the plan have finished
+	Hooks `yaml:",inline"`
+}
+
+// Cache modes, determining whether a build reads from and/or writes to the cache
+const (
+	CacheReadWrite = "readwrite"
+	CacheRead      = "read"
+	CacheWrite     = "write"
+	CacheOff       = "off"
+)
+
+// CacheConfig configures where target caches are stored and how
+type CacheConfig struct {
+	Directory *string `yaml:"directory"`
+	// Store each output file by its content hash, with a manifest per cache entry
+	CAS bool `yaml:"cas"`
+	// Evict least recently used entries beyond this size (e.g. 20GB) at the end of each build
+	MaxSize *string `yaml:"max_size"`
+	// Evict entries not accessed for longer than this (e.g. 14d) at the end of each build
+	MaxAge *string `yaml:"max_age"`
+	// One of readwrite (default), read, write or off
+	Mode *string `yaml:"mode"`
+	// Sign cache entries on write, and reject entries whose signature does not verify on read
+	Signing *SigningConfig `yaml:"signing"`
+	// Hash algorithm for checksumming inputs and outputs, sha256 (default) or md5
+	Hash *string `yaml:"hash"`
+}
+
+func (config *CacheConfig) hashAlgorithm() string {
+	if config == nil || config.Hash == nil {
+		return SHA256
+	}
+	return *config.Hash
+}
+
+type SigningConfig struct {
+	// hmac (default) or ed25519
+	Algorithm *string `yaml:"algorithm"`
+	// Environment variable holding the HMAC secret or base64 encoded ed25519 private key, GBUILD_CACHE_KEY by default
+	KeyEnv *string `yaml:"key_env"`
+	// Base64 encoded ed25519 public key, which allows verifying entries without the private key
+	PublicKey *string `yaml:"public_key"`
+}
+
+func (config *CacheConfig) mode() string {
+	if config == nil || config.Mode == nil {
+		return CacheReadWrite
+	}
+	return *config.Mode
+}
+
+// CanRead is true if the cache mode allows restoring from the cache
+func (config *CacheConfig) CanRead() bool {
+	return config.mode() == CacheReadWrite || config.mode() == CacheRead
+}
+
+// CanWrite is true if the cache mode allows writing to the cache
+func (config *CacheConfig) CanWrite() bool {
+	return config.mode() == CacheReadWrite || config.mode() == CacheWrite
 }
 
 type Config struct {
 	Targets        []Target        `yaml:"targets"`
 	ExecutionPlans []ExecutionPlan `yaml:"execution_plans"`
+	Cache          *CacheConfig    `yaml:"cache"`
+	// Shell to run the run blocks of targets with, /bin/sh -e by default
+	Shell *string `yaml:"shell"`
+	// Environment variables of all targets
+	Env     map[string]string `yaml:"env"`
+	EnvFile *string           `yaml:"env_file"`
 }
 
 func LoadConfig(filename string, log Log) (*Config, error) {
@@ -43,6 +199,10 @@ func LoadConfig(filename string, log Log) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("in file %q: %v", filename, err)
 	}
+	err = expandMatrix(c)
+	if err != nil {
+		return nil, err
+	}
 	err = validate(c, log)
 	if err != nil {
 		return nil, err
@@ -60,6 +220,14 @@ func GetTargetsForPlan(config *Config, planName string, log Log) ([]Target, erro
 			for _, targetName := range pl.Targets {
 				for _, target := range cfg.Targets {
 					if target.Name == targetName {
+						env, err := resolveEnv(config, &pl, &target)
+						if err != nil {
+							return nil, fmt.Errorf("in the environment of %v: %v", target.Name, err)
+						}
+						target.Env = env
+						if target.Shell == nil {
+							target.Shell = config.Shell
+						}
 						targets = append(targets, target)
 					}
 				}
@@ -73,6 +241,43 @@ func GetTargetsForPlan(config *Config, planName string, log Log) ([]Target, erro
 	return targets, nil
 }
 
+// GetPlanHooks returns the hooks of a plan as a target, with the shell of the config and the environment of the plan,
+// or nil if the plan has no hooks
+func GetPlanHooks(config *Config, planName string) (*Target, error) {
+	for _, plan := range config.ExecutionPlans {
+		if plan.Name != planName || plan.Hooks == (Hooks{}) {
+			continue
+		}
+		env, err := resolveEnv(config, &plan, &Target{})
+		if err != nil {
+			return nil, fmt.Errorf("in the environment of %v: %v", plan.Name, err)
+		}
+		return &Target{Name: plan.Name, Shell: config.Shell, Env: env, Hooks: plan.Hooks}, nil
+	}
+	return nil, nil
+}
+
+// CacheModeForPlan returns the cache mode to use for a plan, where a non-empty override takes precedence
+// over the cache_mode of the plan, which in turn takes precedence over the mode of the cache config
+func CacheModeForPlan(config *Config, planName string, override string) (string, error) {
+	if override != "" {
+		if !isCacheMode(override) {
+			return "", fmt.Errorf("invalid cache mode %v, must be one of readwrite, read, write or off", override)
+		}
+		return override, nil
+	}
+	for _, plan := range config.ExecutionPlans {
+		if plan.Name == planName && plan.CacheMode != nil {
+			return *plan.CacheMode, nil
+		}
+	}
+	return config.Cache.mode(), nil
+}
+
+func isCacheMode(mode string) bool {
+	return containsString(mode, []string{CacheReadWrite, CacheRead, CacheWrite, CacheOff})
+}
+
 func validate(c *Config, log Log) error {
 	conf := *c
 	var targetNames []string
@@ -84,6 +289,37 @@ func validate(c *Config, log Log) error {
 		if target.DependsOn != nil && containsString(target.Name, *target.DependsOn) {
 			return fmt.Errorf("the %v depends on itself, this is not permissible", target.Name)
 		}
+		if target.Command != nil && (len(*target.Command) == 0 || target.Run != "" || target.Shell != nil) {
+			return fmt.Errorf("the target %v must have either a run block, optionally with a shell, or a non-empty command", target.Name)
+		}
+		if target.Shell != nil && len(strings.Fields(*target.Shell)) == 0 {
+			return fmt.Errorf("the shell of the target %v is empty", target.Name)
+		}
+		if err := validateService(target); err != nil {
+			return err
+		}
+		if target.When != nil {
+			if _, err := parseWhen(*target.When); err != nil {
+				return fmt.Errorf("invalid when condition of the target %v: %v", target.Name, err)
+			}
+		}
+	}
+
+	if conf.Shell != nil && len(strings.Fields(*conf.Shell)) == 0 {
+		return fmt.Errorf("the shell of the config is empty")
+	}
+	if _, _, err := GCLimits(conf.Cache); err != nil {
+		return fmt.Errorf("invalid cache config: %v", err)
+	}
+	if !isCacheMode(conf.Cache.mode()) {
+		return fmt.Errorf("invalid cache mode %v, must be one of readwrite, read, write or off", conf.Cache.mode())
+	}
+	if !containsString(conf.Cache.hashAlgorithm(), []string{SHA256, MD5}) {
+		return fmt.Errorf("unknown cache hash algorithm %v, must be sha256 or md5", conf.Cache.hashAlgorithm())
+	}
+	if conf.Cache != nil && conf.Cache.Signing != nil && conf.Cache.Signing.Algorithm != nil &&
+		!containsString(*conf.Cache.Signing.Algorithm, []string{"hmac", "ed25519"}) {
+		return fmt.Errorf("unknown cache signing algorithm %v, must be hmac or ed25519", *conf.Cache.Signing.Algorithm)
 	}
 
 	var planNames []string
@@ -91,6 +327,9 @@ func validate(c *Config, log Log) error {
 		if containsString(plan.Name, planNames) {
 			return fmt.Errorf("an execution plan with name %v is defined twice, names must be unique", plan.Name)
 		}
+		if plan.CacheMode != nil && !isCacheMode(*plan.CacheMode) {
+			return fmt.Errorf("invalid cache mode %v in the execution plan %v, must be one of readwrite, read, write or off", *plan.CacheMode, plan.Name)
+		}
 		var planTargets []string
 		planNames = append(planNames, plan.Name)
 		for _, target := range plan.Targets {
@@ -1,7 +1,10 @@
 package internal
 
 import (
+	"strings"
 	"testing"
+
+	"gopkg.in/yaml.v2"
 )
 
 var log = NoLog{}
@@ -67,11 +70,11 @@ func TestLoadFileThatFailsValidation(t *testing.T) {
 
 func TestTargetDefinedTwiceValidation(t *testing.T) {
 	c := &Config{
-		[]Target{
-			{"foo", nil, nil, "bar", nil, nil},
-			{"foo", nil, nil, "bar", nil, nil},
+		Targets: []Target{
+			{Name: "foo", Run: "bar"},
+			{Name: "foo", Run: "bar"},
 		},
-		[]ExecutionPlan{},
+		ExecutionPlans: []ExecutionPlan{},
 	}
 
 	err := validate(c, log)
@@ -82,10 +85,10 @@ func TestTargetDefinedTwiceValidation(t *testing.T) {
 
 func TestTargetSelfDependentValidations(t *testing.T) {
 	c := &Config{
-		[]Target{
-			{"foo", nil, nil, "bar", &[]string{"foo"}, nil},
+		Targets: []Target{
+			{Name: "foo", Run: "bar", DependsOn: &[]string{"foo"}},
 		},
-		[]ExecutionPlan{},
+		ExecutionPlans: []ExecutionPlan{},
 	}
 
 	err := validate(c, log)
@@ -96,10 +99,10 @@ func TestTargetSelfDependentValidations(t *testing.T) {
 
 func TestTargetNotDefined(t *testing.T) {
 	c := &Config{
-		[]Target{
-			{"foo", nil, nil, "bar", nil, nil},
+		Targets: []Target{
+			{Name: "foo", Run: "bar"},
 		},
-		[]ExecutionPlan{{"foo", []string{"bar"}}, {"bar", []string{}}},
+		ExecutionPlans: []ExecutionPlan{{Name: "foo", Targets: []string{"bar"}}, {Name: "bar", Targets: []string{}}},
 	}
 
 	err := validate(c, log)
@@ -110,12 +113,12 @@ func TestTargetNotDefined(t *testing.T) {
 
 func TestDuplicatePlanName(t *testing.T) {
 	c := &Config{
-		[]Target{
-			{"foo", nil, nil, "bar", nil, nil},
+		Targets: []Target{
+			{Name: "foo", Run: "bar"},
 		},
-		[]ExecutionPlan{
-			{"foo", []string{"foo"}},
-			{"foo", []string{"foo"}},
+		ExecutionPlans: []ExecutionPlan{
+			{Name: "foo", Targets: []string{"foo"}},
+			{Name: "foo", Targets: []string{"foo"}},
 		},
 	}
 
@@ -127,10 +130,10 @@ func TestDuplicatePlanName(t *testing.T) {
 
 func TestDuplicateTargetInPlan(t *testing.T) {
 	c := &Config{
-		[]Target{
-			{"foo", nil, nil, "bar", nil, nil},
+		Targets: []Target{
+			{Name: "foo", Run: "bar"},
 		},
-		[]ExecutionPlan{{"bar", []string{"foo", "foo"}}},
+		ExecutionPlans: []ExecutionPlan{{Name: "bar", Targets: []string{"foo", "foo"}}},
 	}
 
 	err := validate(c, log)
@@ -142,10 +145,10 @@ func TestDuplicateTargetInPlan(t *testing.T) {
 
 func TestGetTargetsForPlan(t *testing.T) {
 	c := &Config{
-		[]Target{
-			{"foo", nil, nil, "bar", nil, nil},
+		Targets: []Target{
+			{Name: "foo", Run: "bar"},
 		},
-		[]ExecutionPlan{{"foo", []string{"foo"}}},
+		ExecutionPlans: []ExecutionPlan{{Name: "foo", Targets: []string{"foo"}}},
 	}
 
 	targets, err := GetTargetsForPlan(c, "foo", log)
@@ -156,10 +159,10 @@ func TestGetTargetsForPlan(t *testing.T) {
 
 func TestGetTargetsForPlanFailure(t *testing.T) {
 	c := &Config{
-		[]Target{
-			{"foo", nil, nil, "bar", &[]string{"foo"}, nil},
+		Targets: []Target{
+			{Name: "foo", Run: "bar", DependsOn: &[]string{"foo"}},
 		},
-		[]ExecutionPlan{{"foo", []string{"foo"}}},
+		ExecutionPlans: []ExecutionPlan{{Name: "foo", Targets: []string{"foo"}}},
 	}
 
 	_, err := GetTargetsForPlan(c, "bar", log)
@@ -170,10 +173,10 @@ func TestGetTargetsForPlanFailure(t *testing.T) {
 
 func TestGetTargetsForPlanFailure2(t *testing.T) {
 	c := &Config{
-		[]Target{
-			{"foo", nil, nil, "bar", nil, nil},
+		Targets: []Target{
+			{Name: "foo", Run: "bar"},
 		},
-		[]ExecutionPlan{{"foo", []string{}}},
+		ExecutionPlans: []ExecutionPlan{{Name: "foo", Targets: []string{}}},
 	}
 
 	_, err := GetTargetsForPlan(c, "foo", log)
@@ -181,3 +184,173 @@ func TestGetTargetsForPlanFailure2(t *testing.T) {
 		t.Fatal("Did not expect an error here, expected 1 target")
 	}
 }
+
+func TestCacheModeForPlan(t *testing.T) {
+	c := &Config{
+		Targets:        []Target{{Name: "foo", Run: "bar"}},
+		ExecutionPlans: []ExecutionPlan{{Name: "pr", Targets: []string{"foo"}, CacheMode: String(CacheRead)}, {Name: "main", Targets: []string{"foo"}}},
+		Cache:          &CacheConfig{Mode: String(CacheOff)},
+	}
+
+	for _, tc := range []struct{ plan, override, expected string }{
+		{"pr", "", CacheRead},
+		{"main", "", CacheOff},
+		{"pr", CacheWrite, CacheWrite},
+	} {
+		mode, err := CacheModeForPlan(c, tc.plan, tc.override)
+		if err != nil || mode != tc.expected {
+			t.Fatalf("Expected %v for plan %v, got %v, %v", tc.expected, tc.plan, mode, err)
+		}
+	}
+
+	_, err := CacheModeForPlan(c, "pr", "sometimes")
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+}
+
+func TestInvalidCacheModeValidation(t *testing.T) {
+	c := &Config{
+		Targets:        []Target{{Name: "foo", Run: "bar"}},
+		ExecutionPlans: []ExecutionPlan{{Name: "pr", Targets: []string{"foo"}, CacheMode: String("sometimes")}},
+	}
+
+	err := validate(c, log)
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+}
+
+func TestCommandOrRunValidation(t *testing.T) {
+	for _, target := range []Target{
+		{Name: "foo", Run: "bar", Command: &[]string{"bar"}},
+		{Name: "foo", Command: &[]string{}},
+		{Name: "foo", Shell: String("bash"), Command: &[]string{"bar"}},
+		{Name: "foo", Run: "bar", Shell: String(" ")},
+	} {
+		err := validate(&Config{Targets: []Target{target}}, l)
+		if err == nil {
+			t.Fatalf("Expected an error for %v but got none", target)
+		}
+	}
+}
+
+func TestShellDefaultsToConfig(t *testing.T) {
+	config := &Config{
+		Shell:          String("bash -eu"),
+		Targets:        []Target{{Name: "foo", Run: "bar"}, {Name: "baz", Run: "bar", Shell: String("zsh")}},
+		ExecutionPlans: []ExecutionPlan{{Name: "plan", Targets: []string{"foo", "baz"}}},
+	}
+	targets, err := GetTargetsForPlan(config, "plan", l)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if *targets[0].Shell != "bash -eu" || *targets[1].Shell != "zsh" {
+		t.Fatalf("Expected the shell of the config to be the default, got %v and %v", *targets[0].Shell, *targets[1].Shell)
+	}
+}
+
+func TestAllowFailureConfig(t *testing.T) {
+	targets := []Target{}
+	err := yaml.Unmarshal([]byte(`
+- name: lint
+  allow_failure: true
+- name: scan
+  allow_failure:
+    exit_codes: [1, 137]
+- name: build
+  allow_failure: false
+`), &targets)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if !targets[0].AllowFailure.allows(Int(5)) || !targets[0].AllowFailure.allows(nil) {
+		t.Fatal("Expected lint to be allowed to fail with any exit code")
+	}
+	if !targets[1].AllowFailure.allows(Int(137)) || targets[1].AllowFailure.allows(Int(2)) || targets[1].AllowFailure.allows(nil) {
+		t.Fatal("Expected scan to be allowed to fail with exit codes 1 and 137 only")
+	}
+	if targets[2].AllowFailure.allows(Int(1)) {
+		t.Fatal("Expected build not to be allowed to fail")
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	config := &Config{}
+	err := yaml.Unmarshal([]byte(`
+targets:
+- name: Backend
+  run: sbt ++$MATRIX_SCALA test
+  matrix:
+    scala: [2.12, 2.13]
+    jdk: ["11"]
+  env:
+    SBT_OPTS: -Dscala=${MATRIX_SCALA}
+- name: Frontend
+  run: npm test
+  matrix:
+    node: [16, 18]
+- name: Integration
+  run: ./it.sh
+  depends_on: ["Backend", "Frontend[node=18]"]
+execution_plans:
+- name: build
+  targets: ["Backend", "Frontend[node=18]", "Integration"]
+`), config)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	err = expandMatrix(config)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	err = validate(config, log)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	targets, err := GetTargetsForPlan(config, "build", log)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	var names []string
+	for _, target := range targets {
+		names = append(names, target.Name)
+	}
+	if strings.Join(names, " ") != "Backend[jdk=11,scala=2.12] Backend[jdk=11,scala=2.13] Frontend[node=18] Integration" {
+		t.Fatalf("Expected the plan to run both backends and one frontend, got %v", names)
+	}
+	if targets[1].Env["MATRIX_SCALA"] != "2.13" || targets[1].Env["MATRIX_JDK"] != "11" || targets[1].Env["SBT_OPTS"] != "-Dscala=2.13" {
+		t.Fatalf("Expected the matrix values in the environment, got %v", targets[1].Env)
+	}
+	if strings.Join(*targets[3].DependsOn, " ") != "Backend[jdk=11,scala=2.12] Backend[jdk=11,scala=2.13] Frontend[node=18]" {
+		t.Fatalf("Expected Integration to depend on both backends and one frontend, got %v", *targets[3].DependsOn)
+	}
+
+	config.Targets = []Target{{Name: "Backend", Run: "sbt test", Matrix: map[string][]string{"scala": {}}}}
+	if err := expandMatrix(config); err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+}
+
+func TestMatrixCachesDependOnTheMatrix(t *testing.T) {
+	matrix := map[string][]string{"scala": {"2.12", "2.13"}, "jdk": {"11", "17"}}
+	for _, outputs := range [][]string{{"target"}, {"target/$MATRIX_SCALA"}} {
+		config := &Config{Targets: []Target{{Name: "Backend", Run: "sbt test", Matrix: matrix, Caches: &[]Cache{{Inputs: []string{"src"}, Outputs: outputs}}}}}
+		if err := expandMatrix(config); err == nil {
+			t.Fatalf("Expected an error for combinations sharing the outputs %v but got none", outputs)
+		}
+	}
+
+	config := &Config{Targets: []Target{{Name: "Backend", Run: "sbt test", Matrix: matrix, WorkDir: String("jdk-${MATRIX_JDK}"),
+		Caches: &[]Cache{{Inputs: []string{"src"}, Outputs: []string{"target/$MATRIX_SCALA"}}}}}}
+	if err := expandMatrix(config); err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	target := config.Targets[3]
+	if target.Name != "Backend[jdk=17,scala=2.13]" || *target.WorkDir != "jdk-17" || (*target.Caches)[0].Outputs[0] != "target/2.13" {
+		t.Fatalf("Expected the matrix values in the work dir and outputs of %v, got %v, %v", target.Name, *target.WorkDir, *target.Caches)
+	}
+	if (*config.Targets[0].Caches)[0].Outputs[0] != "target/2.12" {
+		t.Fatalf("Expected each combination to have caches of its own, got %v", *config.Targets[0].Caches)
+	}
+}
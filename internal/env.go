@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// resolveEnv merges the environment variables of the config, the plan, the matrix values of the target and the target,
+// in increasing order of precedence.
+// At each level, env takes precedence over env_file, and ${VAR} in env values expands to a variable of lower precedence,
+// or else of the environment gbuild runs in.
+func resolveEnv(config *Config, plan *ExecutionPlan, target *Target) (map[string]string, error) {
+	env := map[string]string{}
+	levels := []struct {
+		env  map[string]string
+		file *string
+	}{
+		{config.Env, config.EnvFile},
+		{plan.Env, plan.EnvFile},
+		{target.matrixEnv, nil},
+		{target.Env, target.EnvFile},
+	}
+	for _, level := range levels {
+		if level.file != nil {
+			vars, err := godotenv.Read(*level.file)
+			if err != nil {
+				return nil, err
+			}
+			for key, value := range vars {
+				env[key] = value
+			}
+		}
+		expanded := map[string]string{}
+		for key, value := range level.env {
+			expanded[key] = os.Expand(value, func(name string) string {
+				if value, hasKey := env[name]; hasKey {
+					return value
+				}
+				return os.Getenv(name)
+			})
+		}
+		for key, value := range expanded {
+			env[key] = value
+		}
+	}
+	return env, nil
+}
+
+// environ returns the environment of gbuild with the variables of the target added, as expected by exec.Cmd
+func environ(env map[string]string) []string {
+	return append(os.Environ(), envPairs(env)...)
+}
+
+// commandEnv returns the environment to run the commands of the target with, that of gbuild with the variables
+// of the target and the outputs of its dependencies added
+func (target Target) commandEnv() []string {
+	return append(environ(target.Env), envPairs(target.dependencyOutputs)...)
+}
+
+// envPairs returns the variables as sorted key=value pairs
+func envPairs(env map[string]string) []string {
+	var pairs []string
+	for key, value := range env {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// envDigest is the part of the cache key derived from the declared variables of a target, empty if there are none
+func envDigest(env map[string]string, algorithm string) string {
+	if len(env) == 0 {
+		return ""
+	}
+	hash := newHash(algorithm)
+	hash.Write([]byte(strings.Join(envPairs(env), "\n")))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// outputEnv names the file a target can write key=value lines to, which are passed on to its dependents
+const outputEnv = "GBUILD_OUTPUT"
+
+// readOutputs reads the key=value lines written by a target, ignoring empty lines and comments
+func readOutputs(file string) (map[string]string, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	outputs := map[string]string{}
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", line)
+		}
+		outputs[strings.TrimSpace(kv[0])] = kv[1]
+	}
+	return outputs, nil
+}
+
+// dependencyEnv adds the outputs of the dependencies among the results to env as GBUILD_DEP_<TARGET>_<KEY>
+func dependencyEnv(env map[string]string, dependsOn []string, results []TargetResult) map[string]string {
+	merged := map[string]string{}
+	for key, value := range env {
+		merged[key] = value
+	}
+	for _, result := range results {
+		if !containsString(result.Target.Name, dependsOn) {
+			continue
+		}
+		for key, value := range result.Outputs {
+			merged["GBUILD_DEP_"+envName(result.Target.Name)+"_"+envName(key)] = value
+		}
+	}
+	return merged
+}
+
+// envName turns a name into an environment variable name, upper-casing it and replacing any other characters than letters and digits with _
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, name)
+}
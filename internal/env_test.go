@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveEnvPrecedence(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), ".env")
+	ioutil.WriteFile(envFile, []byte("FROM_FILE=file\nLEVEL=file\n"), 0644)
+	os.Setenv("GBUILD_TEST_HOME", "/home/test")
+	defer os.Unsetenv("GBUILD_TEST_HOME")
+
+	config := &Config{Env: map[string]string{"LEVEL": "config", "REGION": "eu"}}
+	plan := &ExecutionPlan{Env: map[string]string{"LEVEL": "plan", "URL": "https://${REGION}.example.com"}, EnvFile: &envFile}
+	target := &Target{Env: map[string]string{"LEVEL": "target", "DIR": "${GBUILD_TEST_HOME}/${FROM_FILE}", "PREVIOUS": "$LEVEL"}}
+
+	env, err := resolveEnv(config, plan, target)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	for key, expected := range map[string]string{
+		"LEVEL":     "target",
+		"REGION":    "eu",
+		"FROM_FILE": "file",
+		"URL":       "https://eu.example.com",
+		"DIR":       "/home/test/file",
+		"PREVIOUS":  "plan",
+	} {
+		if env[key] != expected {
+			t.Fatalf("Expected %v to be %v, got %v", key, expected, env[key])
+		}
+	}
+}
+
+func TestResolveEnvMissingFile(t *testing.T) {
+	_, err := resolveEnv(&Config{EnvFile: String("does-not-exist.env")}, &ExecutionPlan{}, &Target{})
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+}
+
+func TestTargetsForPlanHaveEnv(t *testing.T) {
+	config := &Config{
+		Targets:        []Target{{Name: "foo", Run: `test "$GREETING" = "hello world"`, Env: map[string]string{"GREETING": "${GREETING} world"}}},
+		ExecutionPlans: []ExecutionPlan{{Name: "bar", Targets: []string{"foo"}, Env: map[string]string{"GREETING": "hello"}}},
+	}
+	targets, err := GetTargetsForPlan(config, "bar", l)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	_, err = RunPlan(targets, l)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+}
+
+func TestEnvIsPartOfCacheKey(t *testing.T) {
+	target := cacheToTarget(&[]Cache{{Inputs: []string{"config.go"}}})
+	hasher := &Hasher{Algorithm: SHA256}
+	without, err := calculateCacheState(String("../"), &target, false, hasher)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	target.Env = map[string]string{"SCALA_VERSION": "2.13"}
+	with, err := calculateCacheState(String("../"), &target, false, hasher)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if (*without)[0].InChecksum == (*with)[0].InChecksum {
+		t.Fatal("Expected the environment to change the cache key")
+	}
+}
+
+func TestReadOutputs(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "output")
+	ioutil.WriteFile(file, []byte("# comment\ndigest=sha256:abc\n\nurl=https://example.com/?a=b\n"), 0644)
+	outputs, err := readOutputs(file)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if len(outputs) != 2 || outputs["digest"] != "sha256:abc" || outputs["url"] != "https://example.com/?a=b" {
+		t.Fatalf("Unexpected outputs %v", outputs)
+	}
+
+	ioutil.WriteFile(file, []byte("not a pair\n"), 0644)
+	_, err = readOutputs(file)
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+}
+
+func TestDependencyEnvNames(t *testing.T) {
+	results := []TargetResult{
+		{Target: Target{Name: "front-end"}, Outputs: map[string]string{"image.tag": "1.2"}},
+		{Target: Target{Name: "Other"}, Outputs: map[string]string{"x": "y"}},
+	}
+	env := dependencyEnv(map[string]string{"A": "b"}, []string{"front-end"}, results)
+	if len(env) != 2 || env["GBUILD_DEP_FRONT_END_IMAGE_TAG"] != "1.2" || env["A"] != "b" {
+		t.Fatalf("Unexpected env %v", env)
+	}
+}
@@ -1,9 +1,13 @@
 package internal
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,10 +20,117 @@ type TargetResult struct {
 	Target  Target
 	Wait    *time.Duration
 	Elapsed time.Duration
+	// Outputs written by the target as key=value lines to the file named by $GBUILD_OUTPUT
+	Outputs map[string]string
+	// Path of the full log of the target, if logs are written
+	LogFile *string
+	// One of success, failed, cached, skipped or cancelled
+	Status string
+	// Number of times the target was run, 0 if it was not run
+	Attempts int
+	// Exit code of the last attempt, if it ran to completion
+	ExitCode *int
+	// Index key the outputs were restored by, the checksum of the inputs, and where from
+	CacheKey    string
+	CacheSource string
+	// When the target was scheduled, each attempt to run it, and when its outputs were restored from the cache
+	Scheduled time.Time
+	Runs      []Span
+	Restore   *Span
+	// The target failed, but is allowed to fail, so the plan does not
+	AllowedFailure bool
+	// The target was skipped, as its when condition was not met, which satisfies its dependents
+	ConditionUnmet bool
 }
 
-func scheduleTarget(target Target, waitGroup *sync.WaitGroup, retry int, reads chan readOp, writes chan TargetResult, log Log) {
+// Statuses of targets
+const (
+	StatusSuccess   = "success"
+	StatusFailed    = "failed"
+	StatusCached    = "cached"
+	StatusSkipped   = "skipped"
+	StatusCancelled = "cancelled"
+)
+
+// succeeded is true if the dependents of the target can run
+func (result TargetResult) succeeded() bool {
+	return result.Status == StatusSuccess || result.Status == StatusCached || result.AllowedFailure || result.ConditionUnmet
+}
+
+// failed is true if the target failed, and is not allowed to
+func (result TargetResult) failed() bool {
+	return result.Status == StatusFailed && !result.AllowedFailure
+}
+
+// failed is true if any of the results is a failure, which cancels the rest of the plan
+func failed(results []TargetResult) bool {
+	for _, result := range results {
+		if result.failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// exitCode returns the exit code of a command which ran to completion, or nil if it did not
+func exitCode(err error) *int {
+	if err == nil {
+		return Int(0)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() >= 0 {
+		return Int(exitErr.ExitCode())
+	}
+	return nil
+}
+
+// defaultShell fails on the first failing line of multi-line run blocks
+const defaultShell = "/bin/sh -e"
+
+// targetCommand returns the command of the target, which is either exec'ed directly,
+// or its run block passed to the shell with -c
+func targetCommand(target Target) *exec.Cmd {
+	if target.Command != nil {
+		argv := *target.Command
+		return exec.Command(argv[0], argv[1:]...)
+	}
+	shell := defaultShell
+	if target.Shell != nil {
+		shell = *target.Shell
+	}
+	argv := append(strings.Fields(shell), "-c", target.Run)
+	return exec.Command(argv[0], argv[1:]...)
+}
+
+func scheduleTarget(target Target, waitGroup *sync.WaitGroup, retry int, reads chan readOp, writes chan TargetResult, log Log, options RunOptions) {
 	start := time.Now()
+	skip := func(status string, cacheHit CacheHit) {
+		waitTime := time.Since(start)
+		result := TargetResult{Target: target, Wait: &waitTime, Status: status, Scheduled: start, CacheKey: cacheHit.Key, CacheSource: cacheHit.Source}
+		if status == StatusCached {
+			result.Restore = &cacheHit.Restore
+			result.Outputs = cacheHit.Outputs
+		}
+		result.ConditionUnmet = options.Unmet[target.Name]
+		// a target cancelled before it ran still runs its always hook, as one cancelled while running does
+		if status == StatusCancelled {
+			runConsoleHooks(target, status, target.Name, nil, options.stdout(), log)
+		}
+		writes <- result
+		// there is no goroutine watching for cancellation of targets which are not run
+		waitGroup.Done()
+		waitGroup.Done()
+	}
+	if options.Unmet[target.Name] {
+		log.Info("Target skipped, as its when condition was not met", F("target", target.Name))
+		skip(StatusSkipped, CacheHit{})
+		return
+	}
+	if cacheHit, hit := options.Cached[target.Name]; hit {
+		log.Info("Target restored from cache", F("target", target.Name), F("source", cacheHit.Source))
+		skip(StatusCached, cacheHit)
+		return
+	}
 
 	if target.DependsOn != nil && len(*target.DependsOn) > 0 {
 		completed := false
@@ -31,37 +142,105 @@ func scheduleTarget(target Target, waitGroup *sync.WaitGroup, retry int, reads c
 			reads <- read
 			resp := <-read.resp
 			matches := 0
+			succeeded := true
 			for _, t := range resp {
 				for _, d := range *target.DependsOn {
 					if d == t.Target.Name {
 						matches++
+						succeeded = succeeded && t.succeeded()
 					}
 				}
 			}
 			completed = matches == len(*target.DependsOn)
+			if completed && !succeeded {
+				log.Warn("Target skipped, as a dependency did not succeed", F("target", target.Name))
+				skip(StatusSkipped, CacheHit{})
+				return
+			}
+			if completed && failed(resp) {
+				log.Warn("Target cancelled, as another target failed", F("target", target.Name))
+				skip(StatusCancelled, CacheHit{})
+				return
+			}
+			if completed {
+				target.dependencyOutputs = dependencyEnv(target.dependencyOutputs, *target.DependsOn, resp)
+			}
 		}
 		time.Sleep(5 * time.Millisecond)
 	}
-	runTarget(target, waitGroup, retry, reads, writes, log, start)
+	if options.Cancelled != nil && options.Cancelled(target.Name) {
+		log.Warn("Target cancelled", F("target", target.Name))
+		skip(StatusCancelled, CacheHit{})
+		return
+	}
+	output, err := newTargetOutput(target, options)
+	if err != nil {
+		waitTime := time.Since(start)
+		runConsoleHooks(target, StatusFailed, target.Name, nil, options.stdout(), log)
+		writes <- TargetResult{Err: &err, Target: target, Wait: &waitTime, Elapsed: waitTime, Status: StatusFailed, Scheduled: start}
+		waitGroup.Done()
+		waitGroup.Done()
+		return
+	}
+	if target.Service {
+		runService(target, waitGroup, reads, writes, log, options, start, output)
+		return
+	}
+	runTarget(target, waitGroup, retry, reads, writes, log, options, start, output, nil)
 }
 
-func runTarget(target Target, waitGroup *sync.WaitGroup, retry int, reads chan readOp, writes chan TargetResult, log Log, start time.Time) {
-	waitTime := time.Since(start)
-	log.Printf("Target %v started.. Waited for %v\n", target.Name, waitTime)
-	cmd := exec.Command("/bin/sh", "-c", target.Run)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+func runTarget(target Target, waitGroup *sync.WaitGroup, retry int, reads chan readOp, writes chan TargetResult, log Log, options RunOptions,
+	start time.Time, output *targetOutput, runs []Span) {
+	attemptStart := time.Now()
+	waitTime := attemptStart.Sub(start)
+	if len(runs) > 0 {
+		// the wait of a retried target is until its first attempt
+		waitTime = runs[0].Start.Sub(start)
+	}
+	// the output is complete before the result is written, so grouped output is printed before the plan finishes
+	result := func(status string, err error, elapsed time.Duration, outputs map[string]string) {
+		output.Close()
+		r := TargetResult{Target: target, Wait: &waitTime, Elapsed: elapsed, Outputs: outputs, LogFile: output.LogFile(),
+			Status: status, Attempts: retry, ExitCode: exitCode(err), Scheduled: start, Runs: append(runs, Span{attemptStart, time.Now()})}
+		r.AllowedFailure = status == StatusFailed && target.AllowFailure.allows(r.ExitCode)
+		if err != nil {
+			r.Err = &err
+		}
+		writes <- r
+	}
+	output.attempt(retry)
+	log.Info("Target started", F("target", target.Name), F("attempt", retry), F("wait", waitTime))
+	cmd := targetCommand(target)
+	log.Debug("Running command", F("target", target.Name), F("command", strings.Join(cmd.Args, " ")))
+	cmd.Stdout = output.Stdout()
+	cmd.Stderr = output.Stderr()
+	outputFile, err := ioutil.TempFile("", "gbuild-output-")
+	if err == nil {
+		outputFile.Close()
+		defer os.Remove(outputFile.Name())
+	}
 	if target.WorkDir != nil {
 		if _, err := os.Stat(*target.WorkDir); os.IsNotExist(err) {
-			writes <- TargetResult{&err, target, &waitTime, waitTime}
+			runHooks(target, StatusFailed, target.Name, nil, output.Stdout(), output.Stderr(), log)
+			result(StatusFailed, err, waitTime, nil)
 			waitGroup.Done()
 			waitGroup.Done()
 			return
 		}
 		cmd.Dir = *target.WorkDir
 	}
+	if err != nil {
+		runHooks(target, StatusFailed, target.Name, nil, output.Stdout(), output.Stderr(), log)
+		result(StatusFailed, err, waitTime, nil)
+		waitGroup.Done()
+		waitGroup.Done()
+		return
+	}
+	cmd.Env = append(target.commandEnv(), outputEnv+"="+outputFile.Name())
+	startProcessGroup(cmd)
 	cmd.Start()
 
+	var killed int32
 	go func() {
 		cancelled := false
 		read := readOp{
@@ -71,45 +250,71 @@ func runTarget(target Target, waitGroup *sync.WaitGroup, retry int, reads chan r
 		for !cancelled {
 			reads <- read
 			resp := <-read.resp
+			done := false
 			for _, t := range resp {
 				if t.Target.Name == target.Name {
-					cancelled = true
-					waitGroup.Done()
-					break
-				} else if t.Err != nil {
-					cancelled = true
-					waitGroup.Done()
-					cmd.Process.Kill()
+					done = true
 					break
 				}
 			}
-			if !cancelled {
+			if done {
+				cancelled = true
+				waitGroup.Done()
+			} else if failed(resp) || (options.Cancelled != nil && options.Cancelled(target.Name)) {
+				cancelled = true
+				atomic.StoreInt32(&killed, 1)
+				waitGroup.Done()
+				killProcess(cmd)
+			} else {
 				time.Sleep(5 * time.Millisecond)
 			}
 		}
 	}()
-	err := cmd.Wait()
+	err = cmd.Wait()
 
 	elapsed := time.Since(start)
-	if err != nil {
-		if target.MaxRetries != nil && *target.MaxRetries > retry {
-			log.Printf("Target %v failed, retrying\n", target.Name)
-			waitGroup.Add(1) // add to waitgroup on retry
-			runTarget(target, waitGroup, retry+1, reads, writes, log, start)
-		} else {
-			log.Printf("Target %v failed after %v, reason: \n%v\n\n", target.Name, elapsed, err)
-			writes <- TargetResult{&err, target, &waitTime, elapsed}
-			waitGroup.Done()
-		}
-	} else {
-		log.Printf("Target %v finished successfully after %v\n", target.Name, elapsed)
-		writes <- TargetResult{nil, target, &waitTime, elapsed}
-		waitGroup.Done()
+	cancelled := err != nil && atomic.LoadInt32(&killed) == 1
+	var outputs map[string]string
+	invalidOutputs := false
+	if err == nil {
+		outputs, err = readOutputs(outputFile.Name())
+		invalidOutputs = err != nil
 	}
-
+	if err != nil && !cancelled && !invalidOutputs && target.MaxRetries != nil && *target.MaxRetries > retry {
+		log.Warn("Target failed, retrying", F("target", target.Name), F("attempt", retry), F("error", err))
+		waitGroup.Add(1) // add to waitgroup on retry
+		runTarget(target, waitGroup, retry+1, reads, writes, log, options, start, output, append(runs, Span{attemptStart, time.Now()}))
+		return
+	}
+	status := StatusSuccess
+	if cancelled {
+		status = StatusCancelled
+	} else if err != nil {
+		status = StatusFailed
+	}
+	runHooks(target, status, target.Name, exitCode(err), output.Stdout(), output.Stderr(), log)
+	output.Close()
+	switch {
+	case invalidOutputs:
+		log.Error("Target wrote invalid outputs to $"+outputEnv, F("target", target.Name), F("error", err))
+	case cancelled:
+		log.Warn("Target cancelled", F("target", target.Name), F("attempt", retry), F("duration", elapsed))
+	case err != nil && target.AllowFailure.allows(exitCode(err)):
+		log.Warn("Target failed, which it is allowed to", F("target", target.Name), F("attempt", retry), F("duration", elapsed), F("error", err))
+	case err != nil:
+		log.Error("Target failed", F("target", target.Name), F("attempt", retry), F("duration", elapsed), F("error", err))
+	default:
+		log.Info("Target finished successfully", F("target", target.Name), F("attempt", retry), F("duration", elapsed))
+	}
+	result(status, err, elapsed, outputs)
+	waitGroup.Done()
 }
 
 func RunPlan(targets []Target, log Log) ([]TargetResult, error) {
+	return RunPlanWithOptions(targets, log, RunOptions{})
+}
+
+func RunPlanWithOptions(targets []Target, log Log, options RunOptions) ([]TargetResult, error) {
 	reads := make(chan readOp)
 	writes := make(chan TargetResult)
 
@@ -120,6 +325,12 @@ func RunPlan(targets []Target, log Log) ([]TargetResult, error) {
 	// this is x2, because we have a go routine watching if a target should be cancelled
 	waitGroup.Add(len(targets) * 2)
 
+	options.dependents = serviceDependents(targets)
+	if options.Output == OutputLive {
+		options.display = newLiveDisplay(targets, os.Stdout)
+		options.display.Start()
+	}
+
 	go func() {
 		var state = []TargetResult{}
 		// we wait for the last read to get results, so +1
@@ -128,13 +339,28 @@ func RunPlan(targets []Target, log Log) ([]TargetResult, error) {
 			case read := <-reads:
 				read.resp <- state
 			case write := <-writes:
-				state = append(state, write)
+				if options.display != nil {
+					options.display.finish(write)
+				}
+				// a service which exits before its dependents finished replaces its result with a failure.
+				// Readers hold on to the state they were sent, so it is copied rather than changed in place.
+				replaced := false
+				for i, result := range state {
+					if result.Target.Name == write.Target.Name {
+						state = append(append(append([]TargetResult{}, state[:i]...), write), state[i+1:]...)
+						replaced = true
+						break
+					}
+				}
+				if !replaced {
+					state = append(state, write)
+				}
 			}
 		}
 	}()
 
 	for _, target := range targets {
-		go scheduleTarget(target, &waitGroup, 1, reads, writes, log)
+		go scheduleTarget(target, &waitGroup, 1, reads, writes, log, options)
 	}
 	waitGroup.Wait()
 
@@ -144,14 +370,26 @@ func RunPlan(targets []Target, log Log) ([]TargetResult, error) {
 	defer close(read.resp)
 	reads <- read
 	resp := <-read.resp
+	if options.display != nil {
+		// the last results may not have reached the display yet
+		for _, result := range resp {
+			options.display.finish(result)
+		}
+		options.display.Stop()
+	}
 	var err error
 	// TODO close channels cleanly
 
+	// the error of the plan is that of the target which failed, rather than of those cancelled because of it,
+	// and targets which are allowed to fail do not fail the plan
 	for _, t := range resp {
-		if t.Err != nil {
+		if t.Err != nil && !t.AllowedFailure && (err == nil || t.Status == StatusFailed) {
 			err = *t.Err
 		}
 	}
 
+	if options.PlanHooks != nil {
+		runPlanHooks(*options.PlanHooks, resp, err, options.stdout(), log)
+	}
 	return resp, err
 }
@@ -1,7 +1,12 @@
 package internal
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 var l = NoLog{}
@@ -9,8 +14,8 @@ var l = NoLog{}
 func TestSimpleExecution(t *testing.T) {
 
 	targets := []Target{
-		{"foo", nil, nil, "cd .", nil, nil},
-		{"bar", nil, nil, "cd .", nil, nil},
+		{Name: "foo", Run: "cd ."},
+		{Name: "bar", Run: "cd ."},
 	}
 
 	res, err := RunPlan(targets, l)
@@ -28,8 +33,8 @@ func TestSimpleExecution(t *testing.T) {
 func TestFailedExecutionWithCancelOfOthers(t *testing.T) {
 
 	targets := []Target{
-		{"fast", nil, nil, "asdfasdf", nil, nil},
-		{"slow", nil, nil, "sleep 5", nil, nil},
+		{Name: "fast", Run: "asdfasdf"},
+		{Name: "slow", Run: "sleep 5"},
 	}
 
 	res, err := RunPlan(targets, l)
@@ -46,8 +51,8 @@ func TestFailedExecutionWithCancelOfOthers(t *testing.T) {
 func TestFailedExecutionWithCancelOfOthersRetries(t *testing.T) {
 
 	targets := []Target{
-		{"fast", Int(2), nil, "asdfasdf", nil, nil},
-		{"slow", nil, nil, "sleep 5", nil, nil},
+		{Name: "fast", MaxRetries: Int(2), Run: "asdfasdf"},
+		{Name: "slow", Run: "sleep 5"},
 	}
 
 	res, err := RunPlan(targets, l)
@@ -63,9 +68,9 @@ func TestFailedExecutionWithCancelOfOthersRetries(t *testing.T) {
 
 func TestDependentExecution(t *testing.T) {
 	targets := []Target{
-		{"baz", nil, nil, "cd .", &[]string{"foo", "bar"}, nil},
-		{"foo", nil, nil, "cd .", nil, nil},
-		{"bar", nil, nil, "cd .", &[]string{"foo"}, nil},
+		{Name: "baz", Run: "cd .", DependsOn: &[]string{"foo", "bar"}},
+		{Name: "foo", Run: "cd ."},
+		{Name: "bar", Run: "cd .", DependsOn: &[]string{"foo"}},
 	}
 	for i := 1; i < 100; i++ {
 
@@ -94,7 +99,7 @@ func TestDependentExecution(t *testing.T) {
 
 func TestNonExistentExecutionDir(t *testing.T) {
 	targets := []Target{
-		{"foo", nil, String("foobar"), "cd .", nil, nil},
+		{Name: "foo", WorkDir: String("foobar"), Run: "cd ."},
 	}
 
 	_, err := RunPlan(targets, l)
@@ -106,7 +111,7 @@ func TestNonExistentExecutionDir(t *testing.T) {
 
 func TestExistingDir(t *testing.T) {
 	targets := []Target{
-		{"foo", nil, String("../internal"), "cd .", nil, nil},
+		{Name: "foo", WorkDir: String("../internal"), Run: "cd ."},
 	}
 
 	_, err := RunPlan(targets, l)
@@ -115,3 +120,159 @@ func TestExistingDir(t *testing.T) {
 		t.Fatalf("Did not expect error %v", err)
 	}
 }
+
+func TestOutputsArePassedToDependents(t *testing.T) {
+	targets := []Target{
+		{Name: "Backend", Run: `echo "digest=sha256:abc" >> "$GBUILD_OUTPUT"`},
+		{Name: "PackageBE", Run: `test "$GBUILD_DEP_BACKEND_DIGEST" = "sha256:abc"`, DependsOn: &[]string{"Backend"}},
+	}
+
+	res, err := RunPlan(targets, l)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	for _, r := range res {
+		if r.Target.Name == "Backend" && r.Outputs["digest"] != "sha256:abc" {
+			t.Fatalf("Expected the outputs of Backend to be captured, got %v", r.Outputs)
+		}
+		// the env of a target is part of its cache key, so the outputs of its dependencies must not end up in it
+		for key := range r.Target.Env {
+			if strings.HasPrefix(key, "GBUILD_DEP_") {
+				t.Fatalf("Expected the outputs of dependencies to be kept out of the env of %v, got %v", r.Target.Name, key)
+			}
+		}
+	}
+
+	// restored from the cache, Backend does not run, but its outputs are still passed on
+	targets[0].Run = "exit 1"
+	cached := map[string]CacheHit{"Backend": {Key: "abc", Source: CacheSourceLocal, Outputs: map[string]string{"digest": "sha256:abc"}}}
+	_, err = RunPlanWithOptions(targets, l, RunOptions{Cached: cached})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+}
+
+func TestCancelledTargetKillsItsChildren(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gbuild-cancel-")
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	defer os.RemoveAll(dir)
+	late := filepath.Join(dir, "late")
+	targets := []Target{
+		{Name: "foo", Run: "(sleep 1; touch " + late + ") &\nwait"},
+	}
+	start := time.Now()
+	cancelled := func(string) bool {
+		return time.Since(start) > 200*time.Millisecond
+	}
+
+	res, err := RunPlanWithOptions(targets, l, RunOptions{Cancelled: cancelled})
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+	if res[0].Status != StatusCancelled {
+		t.Fatalf("Expected foo to be cancelled, got %v", res[0].Status)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(late); err == nil {
+		t.Fatal("Expected the children of foo to be killed along with it")
+	}
+}
+
+func TestMultiLineRunFailsOnFirstFailingLine(t *testing.T) {
+	targets := []Target{
+		{Name: "foo", Run: "false\ntrue"},
+	}
+
+	_, err := RunPlan(targets, l)
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+}
+
+func TestShellAndCommand(t *testing.T) {
+	targets := []Target{
+		{Name: "shell", Run: "false\ntrue", Shell: String("/bin/sh")},
+		{Name: "command", Command: &[]string{"test", "a b", "=", "a b"}},
+	}
+
+	_, err := RunPlan(targets, l)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+}
+
+func TestResultStatuses(t *testing.T) {
+	targets := []Target{
+		{Name: "fails", Run: "exit 3"},
+		{Name: "slow", Run: "sleep 5"},
+		{Name: "dependent", Run: "cd .", DependsOn: &[]string{"fails"}},
+		{Name: "cached", Run: "exit 1"},
+	}
+	res, err := RunPlanWithOptions(targets, l, RunOptions{Cached: map[string]CacheHit{"cached": {Key: "abc", Source: CacheSourceLocal}}})
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+	statuses := map[string]TargetResult{}
+	for _, r := range res {
+		statuses[r.Target.Name] = r
+	}
+	if r := statuses["fails"]; r.Status != StatusFailed || r.ExitCode == nil || *r.ExitCode != 3 || r.Attempts != 1 {
+		t.Fatalf("Expected fails to fail with exit code 3, got %v", r)
+	}
+	if r := statuses["slow"]; r.Status != StatusCancelled {
+		t.Fatalf("Expected slow to be cancelled, got %v", r.Status)
+	}
+	if r := statuses["dependent"]; r.Status != StatusSkipped || r.Attempts != 0 {
+		t.Fatalf("Expected dependent to be skipped, got %v", r.Status)
+	}
+	if r := statuses["cached"]; r.Status != StatusCached || r.CacheSource != CacheSourceLocal {
+		t.Fatalf("Expected cached to be restored from the cache, got %v", r.Status)
+	}
+}
+
+func TestAllowFailure(t *testing.T) {
+	targets := []Target{
+		{Name: "scan", Run: "exit 2", AllowFailure: &AllowFailure{Enabled: true, ExitCodes: []int{1, 2}}},
+		{Name: "sibling", Run: "sleep 0.2"},
+		{Name: "dependent", Run: "cd .", DependsOn: &[]string{"scan"}},
+	}
+	res, err := RunPlan(targets, l)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	for _, r := range res {
+		if r.Target.Name == "scan" && (r.Status != StatusFailed || !r.AllowedFailure) {
+			t.Fatalf("Expected scan to be an allowed failure, got %v", r.Status)
+		}
+		if r.Target.Name != "scan" && r.Status != StatusSuccess {
+			t.Fatalf("Expected %v to succeed, got %v", r.Target.Name, r.Status)
+		}
+	}
+
+	targets[0].Run = "exit 3"
+	_, err = RunPlan(targets, l)
+	if err == nil {
+		t.Fatal("Expected an error for an exit code which is not allowed but got none")
+	}
+}
+
+func TestConditionUnmet(t *testing.T) {
+	targets := []Target{
+		{Name: "deploy", Run: "exit 1"},
+		{Name: "notify", Run: "cd .", DependsOn: &[]string{"deploy"}},
+	}
+	res, err := RunPlanWithOptions(targets, l, RunOptions{Unmet: map[string]bool{"deploy": true}})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	for _, r := range res {
+		if r.Target.Name == "deploy" && (r.Status != StatusSkipped || !r.ConditionUnmet || r.Attempts != 0) {
+			t.Fatalf("Expected deploy to be skipped by its condition, got %v", r.Status)
+		}
+		if r.Target.Name == "notify" && r.Status != StatusSuccess {
+			t.Fatalf("Expected notify to run, got %v", r.Status)
+		}
+	}
+}
@@ -1,277 +1,457 @@
 package internal
 
 import (
-	"bufio"
 	"crypto/md5"
 	"encoding/hex"
-	"errors"
 	"fmt"
-	"io/fs"
-	"io/ioutil"
+	"io"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 
-	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
 )
 
-// A result is the product of reading and summing a file using MD5.
-type result struct {
-	path string
-	sum  [md5.Size]byte
-	err  error
+func MD5All(root string, shouldIgnoreFn func(string) bool) (map[string][md5.Size]byte, error) {
+	sums, err := (&Hasher{Algorithm: MD5}).HashAll(root, shouldIgnoreFn)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string][md5.Size]byte)
+	for path, sum := range sums {
+		var arr [md5.Size]byte
+		copy(arr[:], sum)
+		m[path] = arr
+	}
+	return m, nil
 }
 
-type gitignoreFile struct {
-	path    string
-	matcher gitignore.Matcher
+func MD5Dir(root string, shouldIgnoreFn func(string) bool) (*string, error) {
+	return (&Hasher{Algorithm: MD5}).HashDir(root, shouldIgnoreFn)
 }
 
-func sumFiles(done <-chan struct{}, root string, shouldIgnoreFn func(string) bool) (<-chan result, <-chan error) {
-	c := make(chan result)
-	errc := make(chan error, 1)
-	go func() {
-		var wg sync.WaitGroup
-		err := filepath.WalkDir(root, func(path string, info fs.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-			if shouldIgnoreFn(path) {
-				return nil
-			}
-			if !info.Type().IsRegular() {
-				return nil
-			}
-			wg.Add(1)
-			go func() {
-				data, err := ioutil.ReadFile(path)
-				select {
-				case c <- result{path, md5.Sum(data), err}:
-				case <-done:
-				}
-				wg.Done()
-			}()
-			select {
-			case <-done:
-				return errors.New("walk canceled")
-			default:
-				return nil
-			}
-		})
-		go func() {
-			wg.Wait()
-			close(c)
-		}()
-		errc <- err
-	}()
-	return c, errc
+// genShouldIgnoreFn returns a function telling whether a path, relative to the current directory or absolute,
+// is ignored by git or .gbuildignore, see ignorer. Without gitignore, only the .git directory is ignored.
+func genShouldIgnoreFn(projectRoot *string, useGitIgnore bool) (func(string) bool, error) {
+	ig, err := newIgnorer(projectRoot, useGitIgnore)
+	if err != nil {
+		return nil, err
+	}
+	return ig.Ignored, nil
 }
 
-func MD5All(root string, shouldIgnoreFn func(string) bool) (map[string][md5.Size]byte, error) {
-
-	done := make(chan struct{})
-	defer close(done)
-
-	c, errc := sumFiles(done, root, shouldIgnoreFn)
-
-	m := make(map[string][md5.Size]byte)
-	for r := range c {
-		if r.err != nil {
-			return nil, r.err
+func prependPath(relativePath *string, file string) string {
+	if relativePath != nil {
+		if strings.HasSuffix(*relativePath, string(os.PathSeparator)) {
+			return filepath.Join(*relativePath, file)
+		} else {
+			return filepath.Join(*relativePath, file)
 		}
-		m[r.path] = r.sum
-	}
-	if err := <-errc; err != nil {
-		return nil, err
+	} else {
+		if strings.HasPrefix(file, "~") || strings.HasPrefix(file, "$HOME") {
+			homedir, _ := os.UserHomeDir()
+			return filepath.Join(homedir, strings.Replace(strings.Replace(file, "~", "", 1), "$HOME", "", 1))
+		}
+		return file
 	}
-	return m, nil
 }
 
-func MD5Dir(root string, shouldIgnoreFn func(string) bool) (*string, error) {
-	m, err := MD5All(root, shouldIgnoreFn)
+// CheckSumWithGitIgnoreWithRelative checksums the inputs with SHA-256, without a stat cache
+func CheckSumWithGitIgnoreWithRelative(projectRoot *string, relativePath *string, inputs []string, useGitIgnore bool) (*string, error) {
+	return (&Hasher{Algorithm: SHA256}).CheckSumWithGitIgnoreWithRelative(projectRoot, relativePath, inputs, useGitIgnore)
+}
+
+func (h *Hasher) CheckSumWithGitIgnoreWithRelative(projectRoot *string, relativePath *string, inputs []string, useGitIgnore bool) (*string, error) {
+	return h.CheckSumFiles(projectRoot, relativePath, inputs, nil, useGitIgnore)
+}
+
+// CheckSumFiles checksums the files selected by the patterns and excludes, see Cache
+func (h *Hasher) CheckSumFiles(projectRoot *string, relativePath *string, patterns []string, exclude []string, useGitIgnore bool) (*string, error) {
+	set := newFileSet(projectRoot, relativePath, patterns, exclude)
+
+	fn, err := genShouldIgnoreFn(projectRoot, useGitIgnore)
 	if err != nil {
 		return nil, err
 	}
-	var paths []string
-	for path := range m {
-		paths = append(paths, path)
+
+	var sums []string
+	for _, entry := range set.entries {
+		if set.skip(entry) {
+			continue
+		}
+		sum, err := h.HashDir(set.root(entry), set.ignoreFn(entry, fn))
+		if err != nil {
+			return nil, err
+		}
+		sums = append(sums, *sum)
 	}
-	if len(paths) == 1 {
-		return String(fmt.Sprintf("%x", m[paths[0]])), nil
+	if len(set.entries) == 1 && len(sums) == 1 {
+		return &sums[0], nil
 	}
-	sort.Strings(paths)
-	toChecksum := ""
-	for _, path := range paths {
-		toChecksum = toChecksum + fmt.Sprintf("%x", m[path])
+	hash := newHash(h.Algorithm)
+	for _, sum := range sums {
+		hash.Write([]byte(sum))
 	}
-	hash := md5.Sum([]byte(toChecksum))
 
-	return String(hex.EncodeToString(hash[:])), nil
+	return String(hex.EncodeToString(hash.Sum(nil))), nil
 }
 
-func gitignores(root *string) ([]gitignoreFile, error) {
+var repos = map[string]*git.Repository{}
+var reposLock sync.Mutex
 
-	var ignore []gitignoreFile
-	if root == nil {
-		root = String(".")
+// openRepo opens the git repository containing projectRoot, reusing repositories opened before
+func openRepo(projectRoot *string) (*git.Repository, string, error) {
+	root, err := filepath.Abs(prependPath(projectRoot, "."))
+	if err != nil {
+		return nil, "", err
 	}
+	reposLock.Lock()
+	defer reposLock.Unlock()
+	repo, hasKey := repos[root]
+	if !hasKey {
+		repo, err = git.PlainOpenWithOptions(root, &git.PlainOpenOptions{DetectDotGit: true})
+		if err != nil {
+			return nil, "", err
+		}
+		repos[root] = repo
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, "", err
+	}
+	return repo, worktree.Filesystem.Root(), nil
+}
 
-	err := filepath.WalkDir(*root, func(path string, info fs.DirEntry, err error) error {
+// repoPaths returns the inputs as slash separated paths relative to the root of the repository,
+// where the root itself is the empty string
+func repoPaths(repoRoot string, projectRoot *string, relativePath *string, inputs []string) ([]string, error) {
+	var paths []string
+	for _, file := range inputs {
+		abs, err := filepath.Abs(prependPath(projectRoot, prependPath(relativePath, file)))
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if !info.Type().IsRegular() {
-			return nil
+		rel, err := filepath.Rel(repoRoot, abs)
+		if err != nil {
+			return nil, err
 		}
-
-		// could do this with goroutines and channels - make ignore into a channel
-		if info.Name() == ".gitignore" {
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-
-			scanner := bufio.NewScanner(file)
-
-			var patterns []gitignore.Pattern
-
-			for scanner.Scan() {
-				line := strings.TrimSpace(scanner.Text())
-				if len(line) > 0 && !strings.HasPrefix(line, "#") {
-					line = strings.TrimSpace(strings.Split(line, " #")[0])
-					patterns = append(patterns, gitignore.ParsePattern(line, nil))
-				}
-			}
-			path = strings.Replace(strings.Replace(path, *root, "", 1), ".gitignore", "", 1)
-			ignore = append(ignore, gitignoreFile{path, gitignore.NewMatcher(patterns)})
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return nil, fmt.Errorf("%v is outside of the git repository %v", file, repoRoot)
 		}
+		if rel == "." {
+			rel = ""
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+	}
+	return paths, nil
+}
 
+// GetGitHashes returns the last 5 commits that changed any of the files selected by the inputs and excludes, see Cache
+func GetGitHashes(projectRoot *string, relativePath *string, inputs []string, exclude []string) (*[]string, error) {
+	repo, repoRoot, err := openRepo(projectRoot)
+	if err != nil {
+		return nil, err
+	}
+	base, err := repoPaths(repoRoot, projectRoot, relativePath, []string{"."})
+	if err != nil {
+		return nil, err
+	}
+	set := newFileSet(projectRoot, relativePath, inputs, exclude)
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	commits, err := repo.Log(&git.LogOptions{
+		From: head.Hash(),
+		PathFilter: func(file string) bool {
+			rel, err := filepath.Rel(filepath.FromSlash("./"+base[0]), filepath.FromSlash(file))
+			return err == nil && set.contains(filepath.ToSlash(rel))
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer commits.Close()
+	outputs := []string{}
+	err = commits.ForEach(func(commit *object.Commit) error {
+		outputs = append(outputs, commit.Hash.String())
+		if len(outputs) == 5 {
+			return storer.ErrStop
+		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return ignore, err
+	return &outputs, nil
 }
 
-func genShouldIgnoreFn(projectRoot *string, relativePath *string, useGitIgnore bool) (func(string) bool, error) {
-
-	gitPath := prependPath(projectRoot, ".git"+string(os.PathSeparator))
-	if !useGitIgnore {
-		return func(file string) bool {
-			file = prependPath(relativePath, file)
-			return strings.HasPrefix(file, gitPath)
-		}, nil
-	}
-	files, err := gitignores(projectRoot)
-
+// GetGitTreeHash derives the checksum of the inputs selected by the patterns and excludes from the git objects of HEAD,
+// without reading any files. It is only valid for clean checkouts, and returns nil if a literal input is not tracked.
+// Files are selected as by GetBlobHash, which derives the same checksum from the files themselves.
+func GetGitTreeHash(projectRoot *string, relativePath *string, patterns []string, exclude []string, algorithm string) (*string, error) {
+	repo, repoRoot, err := openRepo(projectRoot)
 	if err != nil {
 		return nil, err
 	}
-	ignoreFn := func(file string) bool {
-		file = prependPath(relativePath, file)
-
-		if strings.HasPrefix(file, gitPath) {
-			return true
+	set := newFileSet(projectRoot, relativePath, patterns, exclude)
+	base, err := filepath.Abs(set.base)
+	if err != nil {
+		return nil, err
+	}
+	ignored, err := genShouldIgnoreFn(projectRoot, true)
+	if err != nil {
+		return nil, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	blobs := map[string]string{}
+	// like the files walked by GetBlobHash, only regular files count, and symbolic links and submodules do not
+	add := func(file string, entry object.TreeEntry) {
+		if entry.Mode != filemode.Regular && entry.Mode != filemode.Executable && entry.Mode != filemode.Deprecated {
+			return
+		}
+		abs := filepath.Join(repoRoot, filepath.FromSlash(file))
+		rel, err := filepath.Rel(base, abs)
+		if err != nil || ignored(abs) || !set.contains(filepath.ToSlash(rel)) {
+			return
+		}
+		blobs[filepath.ToSlash(rel)] = entry.Hash.String()
+	}
+	for _, entry := range set.entries {
+		paths, err := repoPaths(repoRoot, nil, nil, []string{set.root(entry)})
+		if err != nil {
+			return nil, err
+		}
+		root := paths[0]
+		dir := tree
+		if root != "" {
+			found, err := tree.FindEntry(root)
+			if err == object.ErrEntryNotFound || err == object.ErrDirectoryNotFound {
+				// a glob without any matches is not an error
+				if entry.glob {
+					continue
+				}
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if found.Mode != filemode.Dir {
+				add(root, *found)
+				continue
+			}
+			dir, err = tree.Tree(root)
+			if err != nil {
+				return nil, err
+			}
 		}
-		for _, gitignore := range files {
-			fname := strings.Replace(file, *projectRoot, "", 1)
-			if strings.HasPrefix(fname, gitignore.path) && gitignore.matcher.Match(strings.Split(fname, string(os.PathSeparator)), false) {
-				return true
+		walker := object.NewTreeWalker(dir, true, nil)
+		for {
+			name, file, err := walker.Next()
+			if err == io.EOF {
+				break
 			}
+			if err != nil {
+				walker.Close()
+				return nil, err
+			}
+			add(path.Join(root, name), file)
 		}
-		return false
+		walker.Close()
 	}
-
-	return ignoreFn, nil
+	return blobKey(blobs, algorithm), nil
 }
 
-func prependPath(relativePath *string, file string) string {
-	if relativePath != nil {
-		if strings.HasSuffix(*relativePath, string(os.PathSeparator)) {
-			return filepath.Join(*relativePath, file)
-		} else {
-			return filepath.Join(*relativePath, file)
+// GetBlobHash derives the checksum of the inputs selected by the patterns and excludes from the files of the work tree,
+// summing them as git blobs, so that it equals GetGitTreeHash on clean checkouts.
+func (h *Hasher) GetBlobHash(projectRoot *string, relativePath *string, patterns []string, exclude []string) (*string, error) {
+	set := newFileSet(projectRoot, relativePath, patterns, exclude)
+	ignored, err := genShouldIgnoreFn(projectRoot, true)
+	if err != nil {
+		return nil, err
+	}
+	blobs := map[string]string{}
+	for _, entry := range set.entries {
+		if set.skip(entry) {
+			continue
 		}
-	} else {
-		if strings.HasPrefix(file, "~") || strings.HasPrefix(file, "$HOME") {
-			homedir, _ := os.UserHomeDir()
-			return filepath.Join(homedir, strings.Replace(strings.Replace(file, "~", "", 1), "$HOME", "", 1))
+		sums, err := h.blobHasher().HashAll(set.root(entry), set.ignoreFn(entry, ignored))
+		if err != nil {
+			return nil, err
+		}
+		for file, sum := range sums {
+			rel, err := filepath.Rel(set.base, file)
+			if err != nil {
+				return nil, err
+			}
+			blobs[filepath.ToSlash(rel)] = hex.EncodeToString(sum)
 		}
-		return file
 	}
+	return blobKey(blobs, h.Algorithm), nil
 }
 
-func CheckSumWithGitIgnoreWithRelative(projectRoot *string, relativePath *string, inputs []string, useGitIgnore bool) (*string, error) {
-	var calculatedInputs []string
-	for _, file := range inputs {
-		calculatedInputs = append(calculatedInputs, prependPath(projectRoot, prependPath(relativePath, file)))
+// blobKey sums the paths of the files, relative to the work dir, along with their git blob ids
+func blobKey(blobs map[string]string, algorithm string) *string {
+	var files []string
+	for file := range blobs {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	hash := newHash(algorithm)
+	for _, file := range files {
+		fmt.Fprintf(hash, "%v %v\n", file, blobs[file])
+	}
+	return String(hex.EncodeToString(hash.Sum(nil)))
+}
+
+func HasGitChanges(projectRoot *string) (bool, error) {
+	repo, _, err := openRepo(projectRoot)
+	if err != nil {
+		return false, err
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return false, err
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return false, err
+	}
+	return !status.IsClean(), nil
+}
+
+func GetGitHash(projectRoot *string) (*string, error) {
+	repo, _, err := openRepo(projectRoot)
+	if err != nil {
+		return nil, err
 	}
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	return String(head.Hash().String()), nil
+}
 
-	fn, err := genShouldIgnoreFn(projectRoot, relativePath, useGitIgnore)
+// GetGitBranch returns the name of the checked out branch, or nil if HEAD is detached
+func GetGitBranch(projectRoot *string) (*string, error) {
+	repo, _, err := openRepo(projectRoot)
+	if err != nil {
+		return nil, err
+	}
+	head, err := repo.Head()
 	if err != nil {
 		return nil, err
 	}
+	if !head.Name().IsBranch() {
+		return nil, nil
+	}
+	return String(head.Name().Short()), nil
+}
 
-	toChecksum := ""
-	if len(calculatedInputs) == 1 {
-		return MD5Dir(calculatedInputs[0], fn)
+// GetChangedFiles returns the files changed in the commits since the revision, and in the working tree,
+// as slash separated paths relative to projectRoot
+func GetChangedFiles(projectRoot *string, since string) ([]string, error) {
+	repo, repoRoot, err := openRepo(projectRoot)
+	if err != nil {
+		return nil, err
 	}
-	for _, input := range calculatedInputs {
-		sum, err := MD5Dir(input, fn)
+	base, err := repoPaths(repoRoot, projectRoot, nil, []string{"."})
+	if err != nil {
+		return nil, err
+	}
+	trees := []*object.Tree{}
+	for _, revision := range []string{since, "HEAD"} {
+		hash, err := repo.ResolveRevision(plumbing.Revision(revision))
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve revision %v: %v", revision, err)
+		}
+		commit, err := repo.CommitObject(*hash)
+		if err != nil {
+			return nil, err
+		}
+		tree, err := commit.Tree()
 		if err != nil {
 			return nil, err
 		}
-		toChecksum = toChecksum + *sum
+		trees = append(trees, tree)
 	}
-	hash := md5.Sum([]byte(toChecksum))
-
-	return String(hex.EncodeToString(hash[:])), nil
-}
-
-func GetGitHashes(projectRoot *string, relativePath *string, inputs []string) (*[]string, error) {
-	var calculatedInputs []string
-	for _, file := range inputs {
-		calculatedInputs = append(calculatedInputs, prependPath(projectRoot, prependPath(relativePath, file)))
+	changes, err := object.DiffTree(trees[0], trees[1])
+	if err != nil {
+		return nil, err
 	}
-	inputFiles := strings.Join(calculatedInputs, " ")
-	command := "git log -5 --pretty=format:\"%H\" -- " + inputFiles
-	out, err := exec.Command("/bin/sh", "-c", command).Output()
+	changed := map[string]bool{}
+	for _, change := range changes {
+		changed[change.From.Name] = true
+		changed[change.To.Name] = true
+	}
+	worktree, err := repo.Worktree()
 	if err != nil {
 		return nil, err
 	}
-	scanner := bufio.NewScanner(strings.NewReader(string(out)))
-	var outputs []string
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if len(line) > 0 {
-			outputs = append(outputs, line)
+	status, err := worktree.Status()
+	if err != nil {
+		return nil, err
+	}
+	for file, fileStatus := range status {
+		if fileStatus.Worktree != git.Unmodified || fileStatus.Staging != git.Unmodified {
+			changed[file] = true
 		}
 	}
-
-	return &outputs, nil
-}
-
-func HasGitChanges(projectRoot *string) (bool, error) {
-	res, err := execGitCmd(projectRoot, "git status -s | wc -l")
-	return res != nil && *res != "0", err
+	var files []string
+	for file := range changed {
+		if file == "" {
+			continue
+		}
+		rel, err := filepath.Rel(filepath.FromSlash("./"+base[0]), filepath.FromSlash(file))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, filepath.ToSlash(rel))
+	}
+	sort.Strings(files)
+	return files, nil
 }
 
-func GetGitHash(projectRoot *string) (*string, error) {
-	return execGitCmd(projectRoot, "git log -1 --pretty=format:\"%H\"")
+func writeFile(path string, reader io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
-func execGitCmd(projectRoot *string, cmd string) (*string, error) {
-	command := exec.Command("/bin/sh", "-c", cmd)
-	if projectRoot != nil {
-		command.Dir = *projectRoot
-	}
-	out, err := command.Output()
+func copyFile(src string, dest string) error {
+	file, err := os.Open(src)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	s := strings.TrimSpace(string(out))
-	return &s, nil
+	defer file.Close()
+	return writeFile(dest, file)
 }
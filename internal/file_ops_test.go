@@ -1,11 +1,18 @@
 package internal
 
 import (
-	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
 func TestCheckSumDir(t *testing.T) {
@@ -39,35 +46,46 @@ func TestCheckSumDirFail(t *testing.T) {
 	}
 }
 
+func ignoreFixture(t *testing.T) string {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, ".git"), os.ModePerm)
+	os.MkdirAll(filepath.Join(dir, "test"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte(".vscode/\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "test", ".gitignore"), []byte("node_modules/\n"), 0644)
+	return dir
+}
+
 func TestIgnoreGeneration(t *testing.T) {
-	fn, err := genShouldIgnoreFn(String("../"), nil, true)
+	dir := ignoreFixture(t)
+	fn, err := genShouldIgnoreFn(String(dir), true)
 	if err != nil {
 		t.Fatalf("Expected no error, found %v", err)
 	}
-	if !fn(".vscode/settings.json") {
+	if !fn(filepath.Join(dir, ".vscode/settings.json")) {
 		t.Fatal("Should be true for .vscode/settings.json")
 	}
 
-	if fn("node_modules/foo") {
+	if fn(filepath.Join(dir, "node_modules/foo")) {
 		t.Fatal("Should be false for node_modules in root")
 	}
 
-	if !fn("test/node_modules/foo") {
+	if !fn(filepath.Join(dir, "test/node_modules/foo")) {
 		t.Fatal("Should be true for node_modules in sub-folder")
 	}
 }
 
 func TestRelativePath(t *testing.T) {
-	fn, err := genShouldIgnoreFn(String("../"), String("test"), true)
+	dir := ignoreFixture(t)
+	fn, err := genShouldIgnoreFn(String(filepath.Join(dir, "test")), true)
 	if err != nil {
 		t.Fatalf("Expected no error, found %v", err)
 	}
-	if !fn(".vscode/settings.json") {
+	if !fn(filepath.Join(dir, "test/.vscode/settings.json")) {
 		t.Fatal("Should be true for .vscode/settings.json")
 	}
 
-	if !fn("node_modules/bar") {
-		t.Fatal("Should be false for node_modules in root")
+	if !fn(filepath.Join(dir, "test/node_modules/bar")) {
+		t.Fatal("Should be true for node_modules in the project")
 	}
 }
 
@@ -75,7 +93,7 @@ func TestSingleInput(t *testing.T) {
 	check := func(str string) bool {
 		return false
 	}
-	res2, err := MD5Dir(".", check)
+	res2, err := (&Hasher{Algorithm: SHA256}).HashDir(".", check)
 	if err != nil {
 		t.Fatalf("Expected no error, found %v", err)
 	}
@@ -93,24 +111,25 @@ func TestDoubleInput(t *testing.T) {
 	check := func(str string) bool {
 		return false
 	}
-	res2, err := MD5Dir(".", check)
+	hasher := &Hasher{Algorithm: SHA256}
+	res2, err := hasher.HashDir(".", check)
 	if err != nil {
 		t.Fatalf("Expected no error, found %v", err)
 	}
-	res3, err := MD5Dir("../cmd", check)
+	res3, err := hasher.HashDir("../cmd", check)
 	if err != nil {
 		t.Fatalf("Expected no error, found %v", err)
 	}
-	hash := md5.Sum([]byte(*res2 + *res3))
+	hash := sha256.Sum256([]byte(*res2 + *res3))
 
-	md5Str := hex.EncodeToString(hash[:])
+	sha256Str := hex.EncodeToString(hash[:])
 
 	res, err := CheckSumWithGitIgnoreWithRelative(String("../"), nil, []string{"internal", "cmd"}, true)
 	if err != nil {
 		t.Fatalf("Expected no error, found %v", err)
 	}
 
-	if *res != md5Str {
+	if *res != sha256Str {
 		t.Fatalf("Expected checksums to match, found %v and %v", *res, *res2)
 	}
 }
@@ -142,7 +161,7 @@ func TestAccountingForGitIgnore(t *testing.T) {
 }
 
 func TestGetGitHashes(t *testing.T) {
-	out, err := GetGitHashes(String("../"), nil, []string{"internal"})
+	out, err := GetGitHashes(String("../"), nil, []string{"internal"}, nil)
 	if err != nil {
 		t.Fatalf("Expected no error, found %v", err)
 	}
@@ -204,3 +223,119 @@ func TestGetGitHash(t *testing.T) {
 		t.Fatalf("Expected error, found %v", err)
 	}
 }
+
+func TestGitWithSpacesInPaths(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatalf("Expected no error, found %v", err)
+	}
+	os.MkdirAll(filepath.Join(dir, "my dir"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(dir, "my dir", "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("b"), 0644)
+	worktree, _ := repo.Worktree()
+	worktree.Add("my dir/a.txt")
+	worktree.Add("b.txt")
+	_, err = worktree.Commit("initial", &git.CommitOptions{Author: &object.Signature{Name: "gbuild", When: time.Now()}})
+	if err != nil {
+		t.Fatalf("Expected no error, found %v", err)
+	}
+
+	hashes, err := GetGitHashes(String(dir), nil, []string{"my dir"}, nil)
+	if err != nil || len(*hashes) != 1 {
+		t.Fatalf("Expected 1 commit, found %v, %v", hashes, err)
+	}
+	hasChanges, err := HasGitChanges(String(dir))
+	if err != nil || hasChanges {
+		t.Fatalf("Expected no changes, found %v, %v", hasChanges, err)
+	}
+	tree, err := GetGitTreeHash(String(dir), nil, []string{"my dir"}, nil, SHA256)
+	if err != nil || tree == nil {
+		t.Fatalf("Expected a tree hash, found %v, %v", tree, err)
+	}
+	blob, err := (&Hasher{Algorithm: SHA256}).GetBlobHash(String(dir), nil, []string{"my dir"}, nil)
+	if err != nil || *blob != *tree {
+		t.Fatalf("Expected the files to hash to the tree hash %v, found %v, %v", *tree, *blob, err)
+	}
+	untracked, err := GetGitTreeHash(String(dir), nil, []string{"not there"}, nil, SHA256)
+	if err != nil || untracked != nil {
+		t.Fatalf("Expected no tree hash for untracked input, found %v, %v", untracked, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "my dir", "a.txt"), []byte("changed"), 0644)
+	hasChanges, err = HasGitChanges(String(dir))
+	if err != nil || !hasChanges {
+		t.Fatalf("Expected changes, found %v, %v", hasChanges, err)
+	}
+}
+
+func TestGitTreeHashFollowsIgnoresAndExcludes(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatalf("Expected no error, found %v", err)
+	}
+	os.MkdirAll(filepath.Join(dir, "src"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(dir, "src", "a.ts"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "src", "b.css"), []byte("b"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "src", "gen.txt"), []byte("gen"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".gbuildignore"), []byte("gen.txt\n"), 0644)
+	worktree, _ := repo.Worktree()
+	worktree.AddGlob(".")
+	_, err = worktree.Commit("initial", &git.CommitOptions{Author: &object.Signature{Name: "gbuild", When: time.Now()}})
+	if err != nil {
+		t.Fatalf("Expected no error, found %v", err)
+	}
+
+	hasher := &Hasher{Algorithm: SHA256}
+	for _, patterns := range [][]string{{"src"}, {"src/*.ts"}, {"."}} {
+		tree, err := GetGitTreeHash(String(dir), nil, patterns, []string{"**/*.css"}, SHA256)
+		if err != nil || tree == nil {
+			t.Fatalf("Expected a tree hash, found %v, %v", tree, err)
+		}
+		// changes to ignored and excluded files leave the tree dirty, but the inputs as they were
+		ioutil.WriteFile(filepath.Join(dir, "src", "b.css"), []byte("b changed"), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "src", "gen.txt"), []byte("gen changed"), 0644)
+		blob, err := hasher.GetBlobHash(String(dir), nil, patterns, []string{"**/*.css"})
+		if err != nil || *blob != *tree {
+			t.Fatalf("Expected the files of %v to hash to the tree hash %v, found %v, %v", patterns, *tree, *blob, err)
+		}
+	}
+}
+
+func TestGetChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatalf("Expected no error, found %v", err)
+	}
+	worktree, _ := repo.Worktree()
+	commit := func(file string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), os.ModePerm)
+		ioutil.WriteFile(filepath.Join(dir, file), []byte(file), 0644)
+		worktree.Add(file)
+		_, err := worktree.Commit(file, &git.CommitOptions{Author: &object.Signature{Name: "gbuild", When: time.Now()}})
+		if err != nil {
+			t.Fatalf("Expected no error, found %v", err)
+		}
+	}
+	commit("web/index.html")
+	commit("infra/main.tf")
+	ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("readme"), 0644)
+
+	branch, err := GetGitBranch(String(dir))
+	if err != nil || branch == nil || *branch != "master" {
+		t.Fatalf("Expected the master branch, found %v, %v", branch, err)
+	}
+	changed, err := GetChangedFiles(String(dir), "HEAD~1")
+	if err != nil {
+		t.Fatalf("Expected no error, found %v", err)
+	}
+	if strings.Join(changed, ",") != "README.md,infra/main.tf" {
+		t.Fatalf("Expected the last commit and the untracked file to have changed, found %v", changed)
+	}
+	_, err = GetChangedFiles(String(dir), "HEAD~5")
+	if err == nil {
+		t.Fatalf("Expected error, found %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chaordic-io/gbuild/pkg/api"
+)
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+}
+
+// ParseSize parses sizes such as 20GB, 512MB or 1024
+func ParseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.bytes
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+func FormatSize(size int64) string {
+	for _, unit := range sizeUnits[:4] {
+		if size >= unit.bytes {
+			return fmt.Sprintf("%.1f%v", float64(size)/float64(unit.bytes), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%vB", size)
+}
+
+// ParseAge parses durations as understood by time.ParseDuration, with the addition of days (14d) and weeks (2w)
+func ParseAge(age string) (time.Duration, error) {
+	s := strings.TrimSpace(age)
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			value, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+			if err != nil || value < 0 {
+				return 0, fmt.Errorf("invalid age %q", age)
+			}
+			return time.Duration(value * float64(unit)), nil
+		}
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age %q", age)
+	}
+	return duration, nil
+}
+
+func FormatAge(age time.Duration) string {
+	switch {
+	case age >= 24*time.Hour:
+		return fmt.Sprintf("%vd", int(age/(24*time.Hour)))
+	case age >= time.Hour:
+		return fmt.Sprintf("%vh", int(age/time.Hour))
+	case age >= time.Minute:
+		return fmt.Sprintf("%vm", int(age/time.Minute))
+	default:
+		return fmt.Sprintf("%vs", int(age/time.Second))
+	}
+}
+
+// GCLimits returns the size and age limits of the config, 0 meaning no limit
+func GCLimits(config *CacheConfig) (int64, time.Duration, error) {
+	var maxSize int64
+	var maxAge time.Duration
+	var err error
+	if config == nil {
+		return 0, 0, nil
+	}
+	if config.MaxSize != nil {
+		maxSize, err = ParseSize(*config.MaxSize)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if config.MaxAge != nil {
+		maxAge, err = ParseAge(*config.MaxAge)
+	}
+	return maxSize, maxAge, err
+}
+
+type workingCacheEntry struct {
+	path       string
+	size       int64
+	lastAccess time.Time
+}
+
+// CollectGarbage evicts the least recently used entries of the local working cache dirs under rootDir,
+// and of the provider if it supports it, until each is within maxSize and no entry is older than maxAge.
+func CollectGarbage(rootDir *string, provider api.CacheProvider, maxSize int64, maxAge time.Duration) (*api.GCResult, error) {
+	result, err := collectWorkingCache(rootDir, maxSize, maxAge)
+	if err != nil {
+		return nil, err
+	}
+	if collector, ok := provider.(api.GarbageCollector); ok {
+		providerResult, err := collector.CollectGarbage(maxSize, maxAge)
+		if err != nil {
+			return nil, err
+		}
+		result.Removed += providerResult.Removed
+		result.FreedBytes += providerResult.FreedBytes
+	}
+	return result, nil
+}
+
+func collectWorkingCache(rootDir *string, maxSize int64, maxAge time.Duration) (*api.GCResult, error) {
+	result := &api.GCResult{}
+	var entries []workingCacheEntry
+	total := int64(0)
+	// the logs of each run are evicted along with the entries, by when the last of them was written
+	for _, name := range []string{"cache", "compressed", "blobs", "logs"} {
+		dir := prependPath(rootDir, filepath.Join(".gbuild_cache", name))
+		files, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			path := filepath.Join(dir, file.Name())
+			size, err := diskUsage(path)
+			if err != nil {
+				return nil, err
+			}
+			lastAccess := file.ModTime()
+			if name == "logs" {
+				lastAccess, err = lastModified(path)
+				if err != nil {
+					return nil, err
+				}
+			}
+			total += size
+			entries = append(entries, workingCacheEntry{path, size, lastAccess})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastAccess.Before(entries[j].lastAccess)
+	})
+
+	for _, entry := range entries {
+		expired := maxAge > 0 && time.Since(entry.lastAccess) > maxAge
+		if !expired && (maxSize <= 0 || total <= maxSize) {
+			break
+		}
+		err := os.RemoveAll(entry.path)
+		if err != nil {
+			return nil, err
+		}
+		total -= entry.size
+		result.Removed++
+		result.FreedBytes += entry.size
+	}
+	return result, nil
+}
+
+func diskUsage(path string) (int64, error) {
+	size := int64(0)
+	err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// lastModified returns when the dir or any file in it was last modified
+func lastModified(path string) (time.Time, error) {
+	var last time.Time
+	err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+		return nil
+	})
+	return last, err
+}
+
+// touch marks a working cache entry as accessed now, which is what LRU eviction is based upon
+func touch(path string) {
+	now := time.Now()
+	os.Chtimes(path, now, now)
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	for in, expected := range map[string]int64{"20GB": 20 << 30, "512mb": 512 << 20, "1.5K": 1536, "100": 100} {
+		size, err := ParseSize(in)
+		if err != nil || size != expected {
+			t.Fatalf("Expected %v for %v, got %v, %v", expected, in, size, err)
+		}
+	}
+	_, err := ParseSize("lots")
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for in, expected := range map[string]time.Duration{"14d": 14 * 24 * time.Hour, "2w": 14 * 24 * time.Hour, "12h": 12 * time.Hour} {
+		age, err := ParseAge(in)
+		if err != nil || age != expected {
+			t.Fatalf("Expected %v for %v, got %v, %v", expected, in, age, err)
+		}
+	}
+	_, err := ParseAge("forever")
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+}
+
+func TestCollectWorkingCache(t *testing.T) {
+	root := t.TempDir()
+	cacheDir := filepath.Join(root, ".gbuild_cache", "cache")
+	os.MkdirAll(filepath.Join(cacheDir, "old"), os.ModePerm)
+	os.MkdirAll(filepath.Join(cacheDir, "new"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(cacheDir, "old", "file"), make([]byte, 100), 0644)
+	ioutil.WriteFile(filepath.Join(cacheDir, "new", "file"), make([]byte, 100), 0644)
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+	os.Chtimes(filepath.Join(cacheDir, "old"), lastWeek, lastWeek)
+
+	res, err := CollectGarbage(String(root), nil, 150, 0)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if res.Removed != 1 || res.FreedBytes != 100 {
+		t.Fatalf("Expected 1 entry of 100 bytes removed, got %v", res)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "old")); !os.IsNotExist(err) {
+		t.Fatal("Expected least recently used entry to be removed")
+	}
+
+	res, err = CollectGarbage(String(root), nil, 0, time.Hour)
+	if err != nil || res.Removed != 0 {
+		t.Fatalf("Expected nothing to be removed, got %v, %v", res, err)
+	}
+}
+
+func TestCollectWorkingCacheEvictsLogs(t *testing.T) {
+	root := t.TempDir()
+	oldRun := LogDir(String(root), "old")
+	newRun := LogDir(String(root), "new")
+	os.MkdirAll(oldRun, os.ModePerm)
+	os.MkdirAll(newRun, os.ModePerm)
+	ioutil.WriteFile(filepath.Join(oldRun, "foo.log"), make([]byte, 100), 0644)
+	ioutil.WriteFile(filepath.Join(newRun, "foo.log"), make([]byte, 100), 0644)
+	lastMonth := time.Now().Add(-30 * 24 * time.Hour)
+	os.Chtimes(filepath.Join(oldRun, "foo.log"), lastMonth, lastMonth)
+	os.Chtimes(oldRun, lastMonth, lastMonth)
+
+	res, err := CollectGarbage(String(root), nil, 0, 14*24*time.Hour)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if res.Removed != 1 || res.FreedBytes != 100 {
+		t.Fatalf("Expected the logs of the old run to be removed, got %v", res)
+	}
+	if _, err := os.Stat(newRun); err != nil {
+		t.Fatalf("Expected the logs of the recent run to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// A fileSet selects files by the inputs or outputs of a cache, relative to the work dir of its target.
+// Each pattern is either a literal file or directory, or a doublestar glob such as src/**/*.ts.
+// Patterns starting with ! and the patterns of the exclude list remove files from the set.
+type fileSet struct {
+	projectRoot  *string
+	relativePath *string
+	base         string
+	entries      []fileSetEntry
+	excludes     []fileSetEntry
+}
+
+type fileSetEntry struct {
+	pattern string
+	glob    bool
+}
+
+func newFileSet(projectRoot *string, relativePath *string, patterns []string, exclude []string) fileSet {
+	set := fileSet{projectRoot: projectRoot, relativePath: relativePath, base: prependPath(projectRoot, prependPath(relativePath, "."))}
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "!") {
+			set.excludes = append(set.excludes, newFileSetEntry(strings.TrimPrefix(pattern, "!")))
+		} else {
+			set.entries = append(set.entries, newFileSetEntry(pattern))
+		}
+	}
+	for _, pattern := range exclude {
+		set.excludes = append(set.excludes, newFileSetEntry(pattern))
+	}
+	return set
+}
+
+func newFileSetEntry(pattern string) fileSetEntry {
+	return fileSetEntry{filepath.ToSlash(pattern), strings.ContainsAny(pattern, "*?[{")}
+}
+
+// matches tells whether a slash separated path, relative to the base of the set, is matched by the entry
+func (entry fileSetEntry) matches(rel string) bool {
+	if entry.glob {
+		match, _ := doublestar.Match(entry.pattern, rel)
+		return match
+	}
+	p := path.Clean(entry.pattern)
+	return p == "." || rel == p || strings.HasPrefix(rel, p+"/")
+}
+
+// root returns the path to walk to find the files matched by the entry
+func (set fileSet) root(entry fileSetEntry) string {
+	if entry.glob {
+		base, _ := doublestar.SplitPattern(entry.pattern)
+		return filepath.Join(set.base, filepath.FromSlash(base))
+	}
+	return prependPath(set.projectRoot, prependPath(set.relativePath, entry.pattern))
+}
+
+func (set fileSet) excluded(rel string) bool {
+	for _, exclude := range set.excludes {
+		if exclude.matches(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains tells whether a slash separated path, relative to the base of the set, is in the set
+func (set fileSet) contains(rel string) bool {
+	if set.excluded(rel) {
+		return false
+	}
+	for _, entry := range set.entries {
+		if entry.matches(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoreFn returns a function for walking the root of the entry, which ignores files not selected by it
+func (set fileSet) ignoreFn(entry fileSetEntry, shouldIgnoreFn func(string) bool) func(string) bool {
+	if !entry.glob && len(set.excludes) == 0 {
+		return shouldIgnoreFn
+	}
+	return func(file string) bool {
+		if shouldIgnoreFn(file) {
+			return true
+		}
+		rel, err := filepath.Rel(set.base, file)
+		if err != nil {
+			return false
+		}
+		rel = filepath.ToSlash(rel)
+		return set.excluded(rel) || (entry.glob && !entry.matches(rel))
+	}
+}
+
+// skip tells whether the root of an entry should be skipped, as a glob without any matches is not an error
+func (set fileSet) skip(entry fileSetEntry) bool {
+	if !entry.glob {
+		return false
+	}
+	_, err := os.Stat(set.root(entry))
+	return os.IsNotExist(err)
+}
+
+// walk calls fn with the path of each regular file in the set, along with its slash separated path relative to the base
+func (set fileSet) walk(shouldIgnoreFn func(string) bool, fn func(path string, rel string) error) error {
+	seen := map[string]bool{}
+	for _, entry := range set.entries {
+		if set.skip(entry) {
+			continue
+		}
+		ignoreFn := set.ignoreFn(entry, shouldIgnoreFn)
+		err := filepath.WalkDir(set.root(entry), func(path string, info fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ignoreFn(path) || !info.Type().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(set.base, path)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if seen[rel] {
+				return nil
+			}
+			seen[rel] = true
+			return fn(path, rel)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func writeTestFiles(t *testing.T, dir string, files ...string) {
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		err := ioutil.WriteFile(path, []byte(file), 0644)
+		if err != nil {
+			t.Fatalf("Did not expect error %v", err)
+		}
+	}
+}
+
+func TestFileSetContains(t *testing.T) {
+	set := newFileSet(String("/project"), String("app"), []string{"src/**/*.ts", "package.json", "!src/**/*.test.ts"}, []string{"src/generated"})
+
+	for rel, expected := range map[string]bool{
+		"src/index.ts":           true,
+		"src/lib/util.ts":        true,
+		"src/lib/util.test.ts":   false,
+		"src/generated/types.ts": false,
+		"src/styles.css":         false,
+		"package.json":           true,
+		"README.md":              false,
+	} {
+		if set.contains(rel) != expected {
+			t.Fatalf("Expected contains(%v) to be %v", rel, expected)
+		}
+	}
+}
+
+func TestFileSetWalk(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, "src/index.ts", "src/lib/util.ts", "src/lib/util.test.ts", "src/styles.css", "node_modules/dep/index.ts")
+
+	set := newFileSet(String(dir), nil, []string{"src/**/*.ts", "!**/*.test.ts", "missing/**/*.ts"}, nil)
+	var files []string
+	err := set.walk(func(string) bool { return false }, func(path string, rel string) error {
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	sort.Strings(files)
+	if len(files) != 2 || files[0] != "src/index.ts" || files[1] != "src/lib/util.ts" {
+		t.Fatalf("Expected the .ts files under src without tests, got %v", files)
+	}
+}
+
+func TestCheckSumFilesWithGlobs(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, "src/index.ts", "src/styles.css")
+	hasher := &Hasher{Algorithm: SHA256}
+
+	literal, err := hasher.CheckSumFiles(String(dir), nil, []string{"src"}, nil, false)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	glob, err := hasher.CheckSumFiles(String(dir), nil, []string{"src/*.ts"}, nil, false)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	excluded, err := hasher.CheckSumFiles(String(dir), nil, []string{"src"}, []string{"**/*.css"}, false)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if *glob == *literal {
+		t.Fatal("Expected the glob to select fewer files than the directory")
+	}
+	if *glob != *excluded {
+		t.Fatalf("Expected the glob and the exclude to select the same files, got %v and %v", *glob, *excluded)
+	}
+
+	writeTestFiles(t, dir, "src/other.css")
+	changed, err := hasher.CheckSumFiles(String(dir), nil, []string{"src/*.ts"}, nil, false)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if *changed != *glob {
+		t.Fatal("Expected files not matched by the glob not to change the checksum")
+	}
+}
@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Hash algorithms for checksumming cache inputs and outputs
+const (
+	MD5    = "md5"
+	SHA256 = "sha256"
+)
+
+// gitBlob sums files as git does its blob objects, so the input checksums of clean checkouts can be read from git
+const gitBlob = "git-blob"
+
+func newHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case MD5:
+		return md5.New()
+	case gitBlob:
+		return sha1.New()
+	}
+	return sha256.New()
+}
+
+// A Hasher sums files with its algorithm, and with a stat cache, skips re-reading files
+// whose path, size, modification time and inode have not changed since they were last summed.
+type Hasher struct {
+	Algorithm string
+	cache     *statCache
+	blobs     *Hasher
+}
+
+type statEntry struct {
+	Size  int64
+	MTime int64
+	Inode uint64
+	Sum   []byte
+}
+
+type statCache struct {
+	path    string
+	lock    sync.Mutex
+	entries map[string]statEntry
+	dirty   bool
+}
+
+// NewHasher returns a hasher with a stat cache persisted under .gbuild_cache in rootDir.
+// A missing or unreadable stat cache starts out empty.
+func NewHasher(rootDir *string, algorithm string) *Hasher {
+	cache := &statCache{
+		path:    prependPath(rootDir, filepath.Join(".gbuild_cache", "stat-"+algorithm)),
+		entries: map[string]statEntry{},
+	}
+	if file, err := os.Open(cache.path); err == nil {
+		if gob.NewDecoder(file).Decode(&cache.entries) != nil {
+			cache.entries = map[string]statEntry{}
+		}
+		file.Close()
+	}
+	hasher := &Hasher{Algorithm: algorithm, cache: cache}
+	if algorithm != gitBlob {
+		hasher.blobs = NewHasher(rootDir, gitBlob)
+	}
+	return hasher
+}
+
+// blobHasher returns the hasher summing files as git blobs, with a stat cache of its own if h has one
+func (h *Hasher) blobHasher() *Hasher {
+	if h.blobs == nil {
+		return &Hasher{Algorithm: gitBlob}
+	}
+	return h.blobs
+}
+
+// Save persists the stat caches, if there are any and they changed
+func (h *Hasher) Save() error {
+	if h.blobs != nil {
+		err := h.blobs.Save()
+		if err != nil {
+			return err
+		}
+	}
+	if h.cache == nil || !h.cache.dirty {
+		return nil
+	}
+	h.cache.lock.Lock()
+	defer h.cache.lock.Unlock()
+	err := os.MkdirAll(filepath.Dir(h.cache.path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmp := h.cache.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(file).Encode(h.cache.entries)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	h.cache.dirty = false
+	return os.Rename(tmp, h.cache.path)
+}
+
+func (c *statCache) lookup(path string, info fs.FileInfo) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, hasKey := c.entries[path]
+	if !hasKey || entry.Size != info.Size() || entry.MTime != info.ModTime().UnixNano() || entry.Inode != inode(info) {
+		return nil, false
+	}
+	return entry.Sum, true
+}
+
+func (c *statCache) store(path string, info fs.FileInfo, sum []byte) {
+	// a file modified within the same timestamp granularity after being summed would go unnoticed,
+	// so recently modified files are summed again next time
+	if c == nil || time.Since(info.ModTime()) < 2*time.Second {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[path] = statEntry{info.Size(), info.ModTime().UnixNano(), inode(info), sum}
+	c.dirty = true
+}
+
+func (h *Hasher) sumFile(path string) ([]byte, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if sum, ok := h.cache.lookup(abs, info); ok {
+		return sum, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := newHash(h.Algorithm)
+	if h.Algorithm == gitBlob {
+		fmt.Fprintf(hash, "blob %d\x00", info.Size())
+	}
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	sum := hash.Sum(nil)
+	h.cache.store(abs, info, sum)
+	return sum, nil
+}
+
+// A result is the product of reading and summing a file.
+type result struct {
+	path string
+	sum  []byte
+	err  error
+}
+
+// sumFiles walks root and sums the files found with a bounded pool of workers
+func (h *Hasher) sumFiles(done <-chan struct{}, root string, shouldIgnoreFn func(string) bool) (<-chan result, <-chan error) {
+	c := make(chan result)
+	errc := make(chan error, 1)
+	paths := make(chan string)
+	go func() {
+		defer close(paths)
+		errc <- filepath.WalkDir(root, func(path string, info fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if shouldIgnoreFn(path) {
+				return nil
+			}
+			if !info.Type().IsRegular() {
+				return nil
+			}
+			select {
+			case paths <- path:
+				return nil
+			case <-done:
+				return errors.New("walk canceled")
+			}
+		})
+	}()
+
+	var wg sync.WaitGroup
+	workers := runtime.NumCPU()
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				sum, err := h.sumFile(path)
+				select {
+				case c <- result{path, sum, err}:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(c)
+	}()
+	return c, errc
+}
+
+func (h *Hasher) HashAll(root string, shouldIgnoreFn func(string) bool) (map[string][]byte, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	c, errc := h.sumFiles(done, root, shouldIgnoreFn)
+
+	m := make(map[string][]byte)
+	for r := range c {
+		if r.err != nil {
+			return nil, r.err
+		}
+		m[r.path] = r.sum
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (h *Hasher) HashDir(root string, shouldIgnoreFn func(string) bool) (*string, error) {
+	m, err := h.HashAll(root, shouldIgnoreFn)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for path := range m {
+		paths = append(paths, path)
+	}
+	if len(paths) == 1 {
+		return String(hex.EncodeToString(m[paths[0]])), nil
+	}
+	sort.Strings(paths)
+	// summing the hex encoded sums in order, rather than concatenating them into one string first
+	hash := newHash(h.Algorithm)
+	for _, path := range paths {
+		hash.Write([]byte(hex.EncodeToString(m[path])))
+	}
+
+	return String(hex.EncodeToString(hash.Sum(nil))), nil
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashDirMatchesMD5Dir(t *testing.T) {
+	check := func(str string) bool {
+		return false
+	}
+	res, err := (&Hasher{Algorithm: MD5}).HashDir("../cmd", check)
+	if err != nil {
+		t.Fatalf("Expected no error, found %v", err)
+	}
+	res2, err := MD5Dir("../cmd", check)
+	if err != nil {
+		t.Fatalf("Expected no error, found %v", err)
+	}
+	if *res != *res2 {
+		t.Fatalf("Expected checksums to match, found %v and %v", *res, *res2)
+	}
+
+	sha, err := (&Hasher{Algorithm: SHA256}).HashDir("../cmd", check)
+	if err != nil || len(*sha) != 64 {
+		t.Fatalf("Expected a SHA-256 checksum, found %v, %v", sha, err)
+	}
+}
+
+func TestStatCache(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "a.txt")
+	ioutil.WriteFile(file, []byte("a"), 0644)
+	lastHour := time.Now().Add(-time.Hour)
+	os.Chtimes(file, lastHour, lastHour)
+
+	hasher := NewHasher(String(root), MD5)
+	sums, err := hasher.HashAll(file, func(string) bool { return false })
+	if err != nil {
+		t.Fatalf("Expected no error, found %v", err)
+	}
+	err = hasher.Save()
+	if err != nil {
+		t.Fatalf("Expected no error, found %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".gbuild_cache", "stat-md5")); err != nil {
+		t.Fatalf("Expected stat cache to be saved, found %v", err)
+	}
+
+	// the stat cache returns the sum of the unchanged file, even though its contents differ
+	abs, _ := filepath.Abs(file)
+	hasher = NewHasher(String(root), MD5)
+	entry := hasher.cache.entries[abs]
+	entry.Sum = []byte("cached")
+	hasher.cache.entries[abs] = entry
+	cached, _ := hasher.HashAll(file, func(string) bool { return false })
+	if string(cached[file]) != "cached" {
+		t.Fatalf("Expected the sum to come from the stat cache, found %v", cached[file])
+	}
+
+	// a changed modification time invalidates the entry
+	os.Chtimes(file, lastHour.Add(time.Minute), lastHour.Add(time.Minute))
+	sums2, _ := hasher.HashAll(file, func(string) bool { return false })
+	expected := md5.Sum([]byte("a"))
+	if hex.EncodeToString(sums2[file]) != hex.EncodeToString(expected[:]) || hex.EncodeToString(sums[file]) != hex.EncodeToString(expected[:]) {
+		t.Fatalf("Expected the file to be summed again, found %v", sums2[file])
+	}
+}
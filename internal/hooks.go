@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"strconv"
+)
+
+// Environment variables of hooks, telling the status of the target or plan, and which target failed with which exit code
+const (
+	statusEnv       = "GBUILD_STATUS"
+	failedTargetEnv = "GBUILD_FAILED_TARGET"
+	exitCodeEnv     = "GBUILD_EXIT_CODE"
+)
+
+// scripts returns the hooks to run for the status, in order
+func (hooks Hooks) scripts(status string) []string {
+	var scripts []string
+	if status == StatusSuccess && hooks.OnSuccess != nil {
+		scripts = append(scripts, *hooks.OnSuccess)
+	}
+	if status == StatusFailed && hooks.OnFailure != nil {
+		scripts = append(scripts, *hooks.OnFailure)
+	}
+	if hooks.Always != nil {
+		scripts = append(scripts, *hooks.Always)
+	}
+	return scripts
+}
+
+// runHooks runs the hooks of the target for the status, with its shell, work dir and environment.
+// If the work dir is missing, which fails the target, they run in the current dir instead.
+// A failing hook is logged, but does not change the status.
+func runHooks(target Target, status string, failedTarget string, exitCode *int, stdout io.Writer, stderr io.Writer, log Log) {
+	for _, script := range target.Hooks.scripts(status) {
+		cmd := targetCommand(Target{Run: script, Shell: target.Shell})
+		if target.WorkDir != nil {
+			if _, err := os.Stat(*target.WorkDir); err == nil {
+				cmd.Dir = *target.WorkDir
+			}
+		}
+		cmd.Env = append(target.commandEnv(), statusEnv+"="+status)
+		if status == StatusFailed {
+			cmd.Env = append(cmd.Env, failedTargetEnv+"="+failedTarget)
+			if exitCode != nil {
+				cmd.Env = append(cmd.Env, exitCodeEnv+"="+strconv.Itoa(*exitCode))
+			}
+		}
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		log.Debug("Running hook", F("target", target.Name), F("status", status))
+		if err := cmd.Run(); err != nil {
+			log.Error("Hook failed", F("target", target.Name), F("status", status), F("error", err))
+		}
+	}
+}
+
+// runPlanHooks runs the hooks of the plan, with the first failed target, if any, printing their output to console
+func runPlanHooks(plan Target, results []TargetResult, err error, console io.Writer, log Log) {
+	status := StatusSuccess
+	failedTarget := ""
+	var exitCode *int
+	if err != nil {
+		status = StatusFailed
+		for _, result := range results {
+			if result.failed() {
+				failedTarget = result.Target.Name
+				exitCode = result.ExitCode
+				break
+			}
+		}
+	}
+	runConsoleHooks(plan, status, failedTarget, exitCode, console, log)
+}
+
+// runConsoleHooks runs the hooks of a target which has no output of its own, as it was not run, or of the plan,
+// printing their output to console
+func runConsoleHooks(target Target, status string, failedTarget string, exitCode *int, console io.Writer, log Log) {
+	if len(target.Hooks.scripts(status)) == 0 {
+		return
+	}
+	prefix := tag(target.Name, useColor()) + " "
+	stdout := &lineWriter{out: console, prefix: prefix}
+	stderr := &lineWriter{out: os.Stderr, prefix: prefix}
+	runHooks(target, status, failedTarget, exitCode, stdout, stderr, log)
+	stdout.flush()
+	stderr.flush()
+}
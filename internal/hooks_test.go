@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestTargetHooks(t *testing.T) {
+	dir := t.TempDir()
+	env := map[string]string{"DIR": dir}
+	hooks := Hooks{
+		OnFailure: String(`echo "$GBUILD_FAILED_TARGET $GBUILD_EXIT_CODE" > $DIR/$GBUILD_STATUS`),
+		OnSuccess: String(`echo ok > $DIR/$GBUILD_STATUS`),
+		Always:    String(`echo always >> $DIR/always`),
+	}
+	targets := []Target{
+		{Name: "Deploy", Run: "exit 4", MaxRetries: Int(2), Env: env, Hooks: hooks},
+	}
+	_, err := RunPlan(targets, l)
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+	if buf, _ := ioutil.ReadFile(filepath.Join(dir, "failed")); string(buf) != "Deploy 4\n" {
+		t.Fatalf("Expected on_failure to run with the failed target and exit code, got %q", string(buf))
+	}
+	if buf, _ := ioutil.ReadFile(filepath.Join(dir, "always")); string(buf) != "always\n" {
+		t.Fatalf("Expected always to run once, after the last attempt, got %q", string(buf))
+	}
+
+	targets[0].Run = "cd ."
+	_, err = RunPlan(targets, l)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if buf, _ := ioutil.ReadFile(filepath.Join(dir, "success")); string(buf) != "ok\n" {
+		t.Fatalf("Expected on_success to run, got %q", string(buf))
+	}
+}
+
+func TestPlanHooks(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{}
+	err := yaml.Unmarshal([]byte(`
+targets:
+- name: Test
+  run: cd .
+- name: Deploy
+  run: exit 3
+  depends_on: [Test]
+execution_plans:
+- name: release
+  targets: [Test, Deploy]
+  env:
+    DIR: `+dir+`
+  on_failure: echo "rollback $GBUILD_FAILED_TARGET $GBUILD_EXIT_CODE" > $DIR/rollback
+  always: echo done > $DIR/always
+`), config)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	targets, err := GetTargetsForPlan(config, "release", l)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	hooks, err := GetPlanHooks(config, "release")
+	if err != nil || hooks == nil {
+		t.Fatalf("Expected plan hooks, got %v, %v", hooks, err)
+	}
+	_, err = RunPlanWithOptions(targets, l, RunOptions{PlanHooks: hooks})
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+	if buf, _ := ioutil.ReadFile(filepath.Join(dir, "rollback")); string(buf) != "rollback Deploy 3\n" {
+		t.Fatalf("Expected on_failure of the plan to run, got %q", string(buf))
+	}
+	if buf, _ := ioutil.ReadFile(filepath.Join(dir, "always")); string(buf) != "done\n" {
+		t.Fatalf("Expected always of the plan to run, got %q", string(buf))
+	}
+	if hooks, _ := GetPlanHooks(&Config{ExecutionPlans: []ExecutionPlan{{Name: "build"}}}, "build"); hooks != nil {
+		t.Fatalf("Expected no hooks, got %v", hooks)
+	}
+}
+
+func TestHooksOfTargetsWhichDidNotRun(t *testing.T) {
+	dir := t.TempDir()
+	env := map[string]string{"DIR": dir}
+	hooks := Hooks{OnFailure: String(`echo "$GBUILD_FAILED_TARGET" > $DIR/failed`), Always: String(`echo $GBUILD_STATUS >> $DIR/always`)}
+	targets := []Target{
+		{Name: "Deploy", WorkDir: String(filepath.Join(dir, "missing")), Run: "cd .", Env: env, Hooks: hooks},
+	}
+	_, err := RunPlan(targets, l)
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+	if buf, _ := ioutil.ReadFile(filepath.Join(dir, "failed")); string(buf) != "Deploy\n" {
+		t.Fatalf("Expected on_failure to run for a missing work dir, got %q", string(buf))
+	}
+
+	// cancelled before it ran
+	targets[0].WorkDir = nil
+	_, err = RunPlanWithOptions(targets, l, RunOptions{Cancelled: func(string) bool { return true }})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if buf, _ := ioutil.ReadFile(filepath.Join(dir, "always")); string(buf) != "failed\ncancelled\n" {
+		t.Fatalf("Expected always to run for a cancelled target, got %q", string(buf))
+	}
+}
@@ -0,0 +1,279 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+)
+
+const gbuildIgnoreFile = ".gbuildignore"
+
+// An ignorer decides which files git ignores, following gitignore(5): patterns are read from core.excludesFile,
+// .git/info/exclude and the .gitignore file of each directory, where the last matching pattern wins,
+// patterns of deeper directories take precedence, and files of an excluded directory cannot be re-included.
+// .gbuildignore files use the same syntax, take precedence over all of the above, and are only read by gbuild.
+type ignorer struct {
+	root     string
+	patterns bool
+	excludes []ignorePattern
+	lock     sync.Mutex
+	dirs     map[string]*ignoreDir
+	ignored  map[string]bool
+}
+
+// ignoreDir holds the patterns of the .gitignore and .gbuildignore files of a directory
+type ignoreDir struct {
+	git    []ignorePattern
+	gbuild []ignorePattern
+}
+
+type ignorePattern struct {
+	dir      string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// newIgnorer returns an ignorer for the git repository containing projectRoot, or for projectRoot itself outside of a repository.
+// Without gitignore patterns, only the .git directory is ignored.
+func newIgnorer(projectRoot *string, useGitIgnore bool) (*ignorer, error) {
+	root, err := filepath.Abs(prependPath(projectRoot, "."))
+	if err != nil {
+		return nil, err
+	}
+	ig := &ignorer{root: root, patterns: useGitIgnore, dirs: map[string]*ignoreDir{}, ignored: map[string]bool{}}
+	for dir := root; ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			ig.root = dir
+			break
+		}
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	if !useGitIgnore {
+		return ig, nil
+	}
+
+	if file := globalExcludesFile(ig.root); file != "" {
+		ig.excludes, err = readIgnoreFile(file, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	excludes, err := readIgnoreFile(filepath.Join(ig.root, ".git", "info", "exclude"), "")
+	if err != nil {
+		return nil, err
+	}
+	ig.excludes = append(ig.excludes, excludes...)
+	return ig, nil
+}
+
+// globalExcludesFile returns the core.excludesFile of the git config, or its default of $XDG_CONFIG_HOME/git/ignore
+func globalExcludesFile(repoRoot string) string {
+	home, _ := os.UserHomeDir()
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	if xdg == "" && home != "" {
+		xdg = filepath.Join(home, ".config")
+	}
+	file := ""
+	var configs []string
+	if xdg != "" {
+		file = filepath.Join(xdg, "git", "ignore")
+		configs = append(configs, filepath.Join(xdg, "git", "config"))
+	}
+	if home != "" {
+		configs = append(configs, filepath.Join(home, ".gitconfig"))
+	}
+	configs = append([]string{"/etc/gitconfig"}, append(configs, filepath.Join(repoRoot, ".git", "config"))...)
+	for _, path := range configs {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		raw := config.New()
+		if config.NewDecoder(bytes.NewReader(buf)).Decode(raw) != nil {
+			continue
+		}
+		if value := raw.Section("core").Options.Get("excludesfile"); value != "" {
+			file = value
+		}
+	}
+	if strings.HasPrefix(file, "~/") && home != "" {
+		file = filepath.Join(home, file[2:])
+	}
+	return file
+}
+
+func readIgnoreFile(file string, dir string) ([]ignorePattern, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if pattern, ok := parseIgnorePattern(scanner.Text(), dir); ok {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns, scanner.Err()
+}
+
+// parseIgnorePattern parses a line of an ignore file in the directory dir, relative to the root
+func parseIgnorePattern(line string, dir string) (ignorePattern, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	// trailing spaces are ignored unless escaped with a backslash
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignorePattern{}, false
+	}
+	pattern := ignorePattern{dir: dir}
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		pattern.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return ignorePattern{}, false
+	}
+	// git has no alternatives, so braces are matched literally
+	pattern.pattern = strings.NewReplacer("{", "\\{", "}", "\\}").Replace(line)
+	return pattern, true
+}
+
+// matches tells whether the pattern matches a slash separated path relative to the root
+func (p ignorePattern) matches(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.dir != "" {
+		if !strings.HasPrefix(rel, p.dir+"/") {
+			return false
+		}
+		rel = rel[len(p.dir)+1:]
+	}
+	if !p.anchored {
+		match, _ := doublestar.Match(p.pattern, path.Base(rel))
+		return match
+	}
+	// a trailing /** matches everything inside a directory, but not the directory itself
+	if strings.HasSuffix(p.pattern, "/**") {
+		if match, _ := doublestar.Match(strings.TrimSuffix(p.pattern, "/**"), rel); match {
+			return false
+		}
+	}
+	match, _ := doublestar.Match(p.pattern, rel)
+	return match
+}
+
+// load returns the patterns of a directory, reading its ignore files the first time
+func (ig *ignorer) load(dir string) (*ignoreDir, error) {
+	if patterns, hasKey := ig.dirs[dir]; hasKey {
+		return patterns, nil
+	}
+	abs := filepath.Join(ig.root, filepath.FromSlash(dir))
+	git, err := readIgnoreFile(filepath.Join(abs, ".gitignore"), dir)
+	if err != nil {
+		return nil, err
+	}
+	gbuild, err := readIgnoreFile(filepath.Join(abs, gbuildIgnoreFile), dir)
+	if err != nil {
+		return nil, err
+	}
+	ig.dirs[dir] = &ignoreDir{git, gbuild}
+	return ig.dirs[dir], nil
+}
+
+// match decides a single path, without regard to its parent directories
+func (ig *ignorer) match(rel string, isDir bool) bool {
+	var dirs []*ignoreDir
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		patterns, err := ig.load(strings.Join(parts[:i], "/"))
+		if err != nil {
+			continue
+		}
+		dirs = append(dirs, patterns)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		for j := len(dirs[i].gbuild) - 1; j >= 0; j-- {
+			if dirs[i].gbuild[j].matches(rel, isDir) {
+				return !dirs[i].gbuild[j].negate
+			}
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		for j := len(dirs[i].git) - 1; j >= 0; j-- {
+			if dirs[i].git[j].matches(rel, isDir) {
+				return !dirs[i].git[j].negate
+			}
+		}
+	}
+	for i := len(ig.excludes) - 1; i >= 0; i-- {
+		if ig.excludes[i].matches(rel, isDir) {
+			return !ig.excludes[i].negate
+		}
+	}
+	return false
+}
+
+// Ignored tells whether a file is ignored, given its path relative to the current directory, or its absolute path
+func (ig *ignorer) Ignored(file string) bool {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(ig.root, abs)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if parts[0] == ".git" {
+		return true
+	}
+	if !ig.patterns {
+		return false
+	}
+
+	ig.lock.Lock()
+	defer ig.lock.Unlock()
+	for i := 1; i < len(parts); i++ {
+		dir := strings.Join(parts[:i], "/")
+		ignored, hasKey := ig.ignored[dir]
+		if !hasKey {
+			ignored = ig.match(dir, true)
+			ig.ignored[dir] = ignored
+		}
+		if ignored {
+			return true
+		}
+	}
+	info, err := os.Lstat(abs)
+	return ig.match(strings.Join(parts, "/"), err == nil && info.IsDir())
+}
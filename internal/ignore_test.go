@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreSemantics(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, ".git", "info"), os.ModePerm)
+	os.MkdirAll(filepath.Join(dir, "app", "logs"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*.log\n!keep.log\n/build\nlogs/\n!logs/kept.txt\nfoo #bar\n\\#hash\ndocs/**\n!docs/README.md\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "app", ".gitignore"), []byte("!debug.log\n/local\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".git", "info", "exclude"), []byte("*.swp\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, gbuildIgnoreFile), []byte("*.tmp\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "app", gbuildIgnoreFile), []byte("!keep.tmp\n"), 0644)
+
+	fn, err := genShouldIgnoreFn(String(dir), true)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	for file, expected := range map[string]bool{
+		"error.log":          true,
+		"keep.log":           false,
+		"app/error.log":      true,
+		"app/debug.log":      false,
+		"build/out.js":       true,
+		"app/build/out.js":   false,
+		"app/local/x":        true,
+		"local/x":            false,
+		"logs/kept.txt":      true,
+		"app/logs/a.txt":     true,
+		"foo #bar":           true,
+		"foo":                false,
+		"#hash":              true,
+		"docs/README.md":     false,
+		"docs/guide.txt":     true,
+		"main.go.swp":        true,
+		"scratch.tmp":        true,
+		"app/keep.tmp":       false,
+		"app/main.go":        false,
+		".git/config":        true,
+		"src/{a,b}.go":       false,
+		"src/nested/keep.go": false,
+	} {
+		if fn(filepath.Join(dir, filepath.FromSlash(file))) != expected {
+			t.Fatalf("Expected %v to be ignored: %v", file, expected)
+		}
+	}
+}
+
+func TestIgnoreWithoutGitIgnore(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, ".git"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*.log\n"), 0644)
+
+	fn, err := genShouldIgnoreFn(String(dir), false)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if fn(filepath.Join(dir, "error.log")) {
+		t.Fatal("Expected error.log not to be ignored without gitignore")
+	}
+	if !fn(filepath.Join(dir, ".git", "HEAD")) {
+		t.Fatal("Expected .git to be ignored")
+	}
+}
+
+func TestGlobalExcludes(t *testing.T) {
+	dir := t.TempDir()
+	config := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, ".git"), os.ModePerm)
+	os.MkdirAll(filepath.Join(config, "git"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(config, "git", "ignore"), []byte(".idea/\n"), 0644)
+
+	xdg, hasXdg := os.LookupEnv("XDG_CONFIG_HOME")
+	os.Setenv("XDG_CONFIG_HOME", config)
+	defer func() {
+		if hasXdg {
+			os.Setenv("XDG_CONFIG_HOME", xdg)
+		} else {
+			os.Unsetenv("XDG_CONFIG_HOME")
+		}
+	}()
+
+	fn, err := genShouldIgnoreFn(String(dir), true)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if !fn(filepath.Join(dir, ".idea", "workspace.xml")) {
+		t.Fatal("Expected .idea to be ignored by the global excludes file")
+	}
+}
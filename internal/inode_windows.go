@@ -0,0 +1,8 @@
+package internal
+
+import "io/fs"
+
+// inodes are not available on windows, so the stat cache relies on size and modification time alone
+func inode(info fs.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// junitLogLines is the number of lines at the end of the log of a failed target included in its failure
+const junitLogLines = 50
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     float64          `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      float64         `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the results of the targets of a plan to file as a JUnit XML test suite, with a test case per target.
+// Failed targets include the tail of their log, and targets which did not run are skipped.
+func WriteJUnit(file string, plan string, started time.Time, duration time.Duration, targets []Target, results []TargetResult) error {
+	suite := junitTestSuite{Name: plan, Time: duration.Seconds(), Timestamp: started.Format("2006-01-02T15:04:05")}
+	for _, target := range targets {
+		for _, result := range results {
+			if result.Target.Name == target.Name {
+				suite.Cases = append(suite.Cases, newJUnitTestCase(plan, result))
+				break
+			}
+		}
+	}
+	for _, testCase := range suite.Cases {
+		suite.Tests++
+		if testCase.Failure != nil {
+			suite.Failures++
+		} else if testCase.Skipped != nil {
+			suite.Skipped++
+		}
+	}
+	suites := junitTestSuites{Name: plan, Tests: suite.Tests, Failures: suite.Failures, Skipped: suite.Skipped, Time: suite.Time, Suites: []junitTestSuite{suite}}
+	buf, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append([]byte(xml.Header), append(buf, '\n')...), 0644)
+}
+
+func newJUnitTestCase(plan string, result TargetResult) junitTestCase {
+	testCase := junitTestCase{Name: result.Target.Name, ClassName: "gbuild." + plan, Time: result.Elapsed.Seconds()}
+	switch result.Status {
+	case StatusFailed:
+		message := "failed"
+		if result.Err != nil {
+			message = (*result.Err).Error()
+		}
+		if result.ExitCode != nil {
+			message = fmt.Sprintf("failed with exit code %v after %v attempt(s)", *result.ExitCode, result.Attempts)
+		}
+		if result.AllowedFailure {
+			message += ", which it is allowed to"
+		}
+		testCase.Failure = &junitMessage{Message: message, Text: logTail(result.LogFile, junitLogLines)}
+	case StatusCached:
+		testCase.Skipped = &junitMessage{Message: "restored from the " + result.CacheSource + " cache"}
+	case StatusSkipped:
+		message := "skipped, as a dependency did not succeed"
+		if result.ConditionUnmet {
+			message = "skipped, as its when condition was not met"
+		}
+		testCase.Skipped = &junitMessage{Message: message}
+	case StatusCancelled:
+		testCase.Skipped = &junitMessage{Message: "cancelled, as another target failed"}
+	}
+	return testCase
+}
+
+// logTail returns the last lines of a log file, or nothing if there is no log
+func logTail(file *string, lines int) string {
+	if file == nil {
+		return ""
+	}
+	buf, err := ioutil.ReadFile(*file)
+	if err != nil {
+		return ""
+	}
+	all := strings.Split(strings.TrimRight(string(buf), "\n"), "\n")
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+	return strings.Join(all, "\n")
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJUnit(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "test.log")
+	var log strings.Builder
+	for i := 1; i <= 60; i++ {
+		fmt.Fprintf(&log, "line %v\n", i)
+	}
+	ioutil.WriteFile(logFile, []byte(log.String()), 0644)
+	err := errors.New("exit status 2")
+
+	targets := []Target{{Name: "build"}, {Name: "test"}, {Name: "deploy"}}
+	results := []TargetResult{
+		{Target: Target{Name: "deploy"}, Status: StatusSkipped},
+		{Target: Target{Name: "test"}, Status: StatusFailed, Err: &err, ExitCode: Int(2), Attempts: 1, Elapsed: 2 * time.Second, LogFile: &logFile},
+		{Target: Target{Name: "build"}, Status: StatusCached, CacheSource: CacheSourceLocal},
+	}
+	file := filepath.Join(dir, "out.xml")
+	err = WriteJUnit(file, "ci", time.Now(), 3*time.Second, targets, results)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+
+	buf, _ := ioutil.ReadFile(file)
+	suites := junitTestSuites{}
+	err = xml.Unmarshal(buf, &suites)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if suites.Tests != 3 || suites.Failures != 1 || suites.Skipped != 2 {
+		t.Fatalf("Unexpected counts %+v", suites)
+	}
+	cases := suites.Suites[0].Cases
+	if cases[0].Name != "build" || cases[0].Skipped == nil || cases[2].Name != "deploy" || cases[2].Skipped == nil {
+		t.Fatalf("Expected build and deploy to be skipped, got %+v", cases)
+	}
+	failure := cases[1].Failure
+	if failure == nil || cases[1].Time != 2 || !strings.Contains(failure.Message, "exit code 2") {
+		t.Fatalf("Expected test to fail, got %+v", cases[1])
+	}
+	if !strings.HasPrefix(failure.Text, "line 11\n") || !strings.HasSuffix(failure.Text, "line 60") {
+		t.Fatalf("Expected the last 50 lines of the log, got %v", failure.Text)
+	}
+}
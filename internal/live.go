@@ -0,0 +1,278 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// States of targets in the live display, in addition to the statuses of finished targets
+const (
+	stateWaiting = "waiting"
+	stateRunning = "running"
+)
+
+var spinner = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// DefaultOutput is the live display when stdout is a terminal, and interleaved output otherwise, such as on CI
+func DefaultOutput() string {
+	_, ci := os.LookupEnv("CI")
+	if !ci && os.Getenv("TERM") != "dumb" && term.IsTerminal(int(os.Stdout.Fd())) {
+		return OutputLive
+	}
+	return OutputInterleaved
+}
+
+// activeDisplay is the live display being shown, if any, which is cleared while log messages are printed above it.
+// It is guarded by consoleLock.
+var activeDisplay *liveDisplay
+
+// A liveDisplay redraws a table of the state of each target, and a progress bar for the plan,
+// in place at the bottom of the terminal
+type liveDisplay struct {
+	out     io.Writer
+	lock    sync.Mutex
+	targets []*liveTarget
+	byName  map[string]*liveTarget
+	started time.Time
+	lines   int
+	frame   int
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type liveTarget struct {
+	name     string
+	state    string
+	start    time.Time
+	elapsed  time.Duration
+	attempts int
+	allowed  bool
+	last     string
+}
+
+func newLiveDisplay(targets []Target, out io.Writer) *liveDisplay {
+	display := &liveDisplay{out: out, byName: map[string]*liveTarget{}, started: time.Now()}
+	for _, target := range targets {
+		t := &liveTarget{name: target.Name, state: stateWaiting}
+		display.targets = append(display.targets, t)
+		display.byName[target.Name] = t
+	}
+	return display
+}
+
+// Start shows the display, redrawing it until Stop is called
+func (display *liveDisplay) Start() {
+	display.stop = make(chan struct{})
+	display.stopped = make(chan struct{})
+	consoleLock.Lock()
+	activeDisplay = display
+	display.draw()
+	consoleLock.Unlock()
+	go func() {
+		defer close(display.stopped)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-display.stop:
+				return
+			case <-ticker.C:
+				consoleLock.Lock()
+				display.clear()
+				display.draw()
+				consoleLock.Unlock()
+			}
+		}
+	}()
+}
+
+// Stop draws the display a last time, leaving it in place above anything printed after it
+func (display *liveDisplay) Stop() {
+	close(display.stop)
+	<-display.stopped
+	consoleLock.Lock()
+	display.clear()
+	display.draw()
+	activeDisplay = nil
+	consoleLock.Unlock()
+}
+
+// attempt marks the target as running its attempt
+func (display *liveDisplay) attempt(name string, attempt int) {
+	display.update(name, func(t *liveTarget) {
+		if t.state != stateRunning {
+			t.start = time.Now()
+		}
+		t.state = stateRunning
+		t.attempts = attempt
+	})
+}
+
+// output records a line of output of the target
+func (display *liveDisplay) output(name string, line string) {
+	display.update(name, func(t *liveTarget) {
+		t.last = line
+	})
+}
+
+// finish marks the target with the status of its result
+func (display *liveDisplay) finish(result TargetResult) {
+	display.update(result.Target.Name, func(t *liveTarget) {
+		t.state = result.Status
+		t.attempts = result.Attempts
+		t.allowed = result.AllowedFailure
+		if span, ran := result.span(); ran {
+			t.elapsed = span.Duration()
+		}
+	})
+}
+
+func (display *liveDisplay) update(name string, fn func(*liveTarget)) {
+	display.lock.Lock()
+	defer display.lock.Unlock()
+	if t, hasKey := display.byName[name]; hasKey {
+		fn(t)
+	}
+}
+
+// clear removes the display from the terminal, with consoleLock held
+func (display *liveDisplay) clear() {
+	if display.lines > 0 {
+		fmt.Fprintf(display.out, "\033[%dA\033[J", display.lines)
+		display.lines = 0
+	}
+}
+
+// draw writes the display to the terminal, with consoleLock held
+func (display *liveDisplay) draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+	rows := display.rows(width)
+	// the display can not be redrawn in place if it scrolls off the terminal
+	if max := height - 2; len(rows) > max && max > 0 {
+		hidden := len(rows) - max + 1
+		rows = append(rows[:max-1], fmt.Sprintf("  ... and %v more", hidden))
+	}
+	lines := append([]string{display.progress(width)}, rows...)
+	display.out.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	display.lines = len(lines)
+	display.frame++
+}
+
+// progress renders the progress bar of the plan
+func (display *liveDisplay) progress(width int) string {
+	display.lock.Lock()
+	finished := 0
+	for _, t := range display.targets {
+		if t.state != stateWaiting && t.state != stateRunning {
+			finished++
+		}
+	}
+	total := len(display.targets)
+	display.lock.Unlock()
+	suffix := fmt.Sprintf(" %v/%v targets %v", finished, total, time.Since(display.started).Round(time.Second))
+	barWidth := width - len(suffix) - 2
+	if barWidth > 40 {
+		barWidth = 40
+	}
+	if barWidth < 0 {
+		barWidth = 0
+	}
+	done := 0
+	if total > 0 {
+		done = barWidth * finished / total
+	}
+	return "[" + strings.Repeat("#", done) + strings.Repeat("-", barWidth-done) + "]" + suffix
+}
+
+// rows renders a row per target, running and failed targets first, each at most width wide
+func (display *liveDisplay) rows(width int) []string {
+	display.lock.Lock()
+	defer display.lock.Unlock()
+	targets := append([]*liveTarget{}, display.targets...)
+	order := map[string]int{stateRunning: 0, StatusFailed: 1, stateWaiting: 2}
+	rank := func(t *liveTarget) int {
+		if r, hasKey := order[t.state]; hasKey {
+			return r
+		}
+		return 3
+	}
+	sort.SliceStable(targets, func(i, j int) bool { return rank(targets[i]) < rank(targets[j]) })
+	nameWidth := 0
+	for _, t := range targets {
+		if len(t.name) > nameWidth {
+			nameWidth = len(t.name)
+		}
+	}
+	var rows []string
+	for _, t := range targets {
+		symbol := " "
+		elapsed := ""
+		switch t.state {
+		case stateRunning:
+			symbol = spinner[display.frame%len(spinner)]
+			elapsed = time.Since(t.start).Round(100 * time.Millisecond).String()
+		case StatusSuccess:
+			symbol = "✓"
+		case StatusFailed:
+			symbol = "✗"
+			if t.allowed {
+				symbol = "!"
+			}
+		}
+		if t.state != stateRunning && t.elapsed > 0 {
+			elapsed = t.elapsed.Round(100 * time.Millisecond).String()
+		}
+		retries := ""
+		if t.attempts > 1 {
+			retries = fmt.Sprintf("retry %v", t.attempts-1)
+		}
+		state := t.state
+		if state == StatusSuccess {
+			state = "done"
+		}
+		row := fmt.Sprintf("%v %-*v %-9v %8v %-8v", symbol, nameWidth, t.name, state, elapsed, retries)
+		if t.state == stateRunning && t.last != "" {
+			row += " " + t.last
+		}
+		rows = append(rows, truncate(strings.TrimRight(row, " "), width))
+	}
+	return rows
+}
+
+// truncate cuts s to at most width runes, so a row does not wrap
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return s
+}
+
+// escapeSequence matches the terminal escape sequences of colored output
+var escapeSequence = regexp.MustCompile("\x1b\\[[0-9;?]*[A-Za-z]")
+
+// A lastLineWriter records the last line of the output of a target in the live display
+type lastLineWriter struct {
+	display *liveDisplay
+	name    string
+}
+
+func (w *lastLineWriter) Write(p []byte) (int, error) {
+	lines := strings.Split(strings.TrimRight(string(p), "\n"), "\n")
+	line := escapeSequence.ReplaceAllString(lines[len(lines)-1], "")
+	if line = strings.TrimSpace(strings.ReplaceAll(line, "\t", " ")); line != "" {
+		w.display.output(w.name, line)
+	}
+	return len(p), nil
+}
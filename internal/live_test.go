@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiveDisplay(t *testing.T) {
+	var out bytes.Buffer
+	display := newLiveDisplay([]Target{{Name: "lint"}, {Name: "build"}, {Name: "test"}}, &out)
+	display.attempt("build", 2)
+	writer := &lineWriter{out: &lastLineWriter{display, "build"}}
+	writer.Write([]byte("compiling\n\033[32m[2/3] linking\033[0m\n"))
+	display.finish(TargetResult{Target: Target{Name: "lint"}, Status: StatusSuccess, Attempts: 1, Runs: []Span{{time.Now(), time.Now().Add(time.Second)}}})
+	display.draw()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[0], "1/3 targets") {
+		t.Fatalf("Expected a progress bar and a row per target, got %q", out.String())
+	}
+	if !strings.Contains(lines[1], "build") || !strings.Contains(lines[1], "running") || !strings.Contains(lines[1], "retry 1") || !strings.HasSuffix(lines[1], " [2/3] linking") {
+		t.Fatalf("Expected build to be running first, with its last line of output, got %q", lines[1])
+	}
+	if !strings.Contains(lines[2], "test") || !strings.Contains(lines[2], "waiting") {
+		t.Fatalf("Expected test to be waiting, got %q", lines[2])
+	}
+	if !strings.Contains(lines[3], "lint") || !strings.Contains(lines[3], "done") || !strings.Contains(lines[3], "1s") {
+		t.Fatalf("Expected lint to be done, got %q", lines[3])
+	}
+
+	out.Reset()
+	display.clear()
+	if out.String() != "\033[4A\033[J" {
+		t.Fatalf("Expected the display to be cleared, got %q", out.String())
+	}
+}
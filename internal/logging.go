@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Level is the severity of a log message, where messages below the level of a log are not logged
+type Level int
+
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (level Level) String() string {
+	switch level {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// Log formats
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// A Field is a key and value attached to a log message, such as the target it is about
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+func (log OSLog) Debug(msg string, fields ...Field) {
+	log.log(LevelDebug, msg, fields)
+}
+
+func (log OSLog) Info(msg string, fields ...Field) {
+	log.log(LevelInfo, msg, fields)
+}
+
+func (log OSLog) Warn(msg string, fields ...Field) {
+	log.log(LevelWarn, msg, fields)
+}
+
+func (log OSLog) Error(msg string, fields ...Field) {
+	log.log(LevelError, msg, fields)
+}
+
+func (log OSLog) log(level Level, msg string, fields []Field) {
+	if level < log.Level {
+		return
+	}
+	if log.Format == LogJSON {
+		record := map[string]interface{}{"time": time.Now().Format(time.RFC3339Nano), "level": level.String(), "msg": msg}
+		for _, field := range fields {
+			record[field.Key] = jsonValue(field.Value)
+		}
+		buf, err := json.Marshal(record)
+		if err != nil {
+			buf, _ = json.Marshal(map[string]interface{}{"level": "error", "msg": "could not encode log message", "error": err.Error()})
+		}
+		log.write(string(buf) + "\n")
+		return
+	}
+
+	var line strings.Builder
+	if level != LevelInfo {
+		line.WriteString(strings.ToUpper(level.String()) + " ")
+	}
+	line.WriteString(msg)
+	for _, field := range fields {
+		value := fmt.Sprint(field.Value)
+		if strings.ContainsAny(value, " \t\n\"=") || value == "" {
+			value = fmt.Sprintf("%q", value)
+		}
+		line.WriteString(" " + field.Key + "=" + value)
+	}
+	log.write(line.String() + "\n")
+}
+
+// jsonValue turns values which do not encode to JSON usefully, such as errors and durations, into strings
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+func (log OSLog) write(s string) (int, error) {
+	consoleLock.Lock()
+	defer consoleLock.Unlock()
+	if log.File != nil {
+		io.WriteString(log.File, s)
+	}
+	// messages are printed above the live display
+	if activeDisplay != nil {
+		activeDisplay.clear()
+		defer activeDisplay.draw()
+	}
+	return io.WriteString(os.Stdout, s)
+}
+
+func (log NoLog) Debug(msg string, fields ...Field) {}
+
+func (log NoLog) Info(msg string, fields ...Field) {}
+
+func (log NoLog) Warn(msg string, fields ...Field) {}
+
+func (log NoLog) Error(msg string, fields ...Field) {}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogLevels(t *testing.T) {
+	var file bytes.Buffer
+	log := OSLog{Level: LevelWarn, File: &file}
+	log.Debug("debug")
+	log.Info("info")
+	log.Printf("printf\n")
+	log.Warn("warn", F("target", "foo"))
+	log.Error("error", F("reason", "no such file"))
+
+	expected := "WARN warn target=foo\nERROR error reason=\"no such file\"\n"
+	if file.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, file.String())
+	}
+}
+
+func TestJSONLog(t *testing.T) {
+	var file bytes.Buffer
+	log := OSLog{Format: LogJSON, File: &file}
+	log.Info("Target failed", F("target", "foo"), F("attempt", 2), F("duration", time.Second), F("error", errors.New("exit status 1")))
+	log.Printf("Removed %v cache entries\n", 3)
+
+	lines := strings.Split(strings.TrimSpace(file.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %v", lines)
+	}
+	record := map[string]interface{}{}
+	err := json.Unmarshal([]byte(lines[0]), &record)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if record["level"] != "info" || record["msg"] != "Target failed" || record["target"] != "foo" ||
+		record["attempt"] != 2.0 || record["duration"] != "1s" || record["error"] != "exit status 1" {
+		t.Fatalf("Unexpected record %v", record)
+	}
+	err = json.Unmarshal([]byte(lines[1]), &record)
+	if err != nil || record["msg"] != "Removed 3 cache entries" {
+		t.Fatalf("Expected Printf to log a message, got %v", lines[1])
+	}
+}
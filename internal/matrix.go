@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// matrixEnv returns the name of the environment variable a matrix value is exposed as, such as MATRIX_SCALA
+func matrixEnv(key string) string {
+	return "MATRIX_" + envName(key)
+}
+
+// matrixCombinations returns every combination of the values of the matrix, varying the values of the last key,
+// in alphabetical order, fastest
+func matrixCombinations(matrix map[string][]string) []map[string]string {
+	var keys []string
+	for key := range matrix {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	combinations := []map[string]string{{}}
+	for _, key := range keys {
+		var next []map[string]string
+		for _, combination := range combinations {
+			for _, value := range matrix[key] {
+				extended := map[string]string{key: value}
+				for k, v := range combination {
+					extended[k] = v
+				}
+				next = append(next, extended)
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
+
+// matrixName names a combination of a target, such as Backend[scala=2.13] or Frontend[node=18,os=linux]
+func matrixName(name string, combination map[string]string) string {
+	var values []string
+	for key, value := range combination {
+		values = append(values, key+"="+value)
+	}
+	sort.Strings(values)
+	return name + "[" + strings.Join(values, ",") + "]"
+}
+
+// expandMatrixVars replaces $MATRIX_<KEY> and ${MATRIX_<KEY>} in s by the values of a combination, leaving anything else as is
+func expandMatrixVars(s string, env map[string]string) string {
+	var names []string
+	for name := range env {
+		names = append(names, name)
+	}
+	// longer names first, so $MATRIX_OS does not replace the start of $MATRIX_OS_VERSION
+	sort.Slice(names, func(i, j int) bool {
+		return len(names[i]) > len(names[j])
+	})
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, "${"+name+"}", env[name], "$"+name, env[name])
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
+
+// expandMatrixPaths expands the matrix values in the work dir and cache paths of an instance of a matrix target,
+// so that each combination can build into, and cache, outputs of its own
+func expandMatrixPaths(instance *Target) {
+	expand := func(paths []string) []string {
+		var expanded []string
+		for _, path := range paths {
+			expanded = append(expanded, expandMatrixVars(path, instance.matrixEnv))
+		}
+		return expanded
+	}
+	if instance.WorkDir != nil {
+		instance.WorkDir = String(expandMatrixVars(*instance.WorkDir, instance.matrixEnv))
+	}
+	if instance.Caches != nil {
+		var caches []Cache
+		for _, cache := range *instance.Caches {
+			caches = append(caches, Cache{expand(cache.Inputs), expand(cache.Outputs), expand(cache.Exclude)})
+		}
+		instance.Caches = &caches
+	}
+}
+
+// sharedOutputs is true if the caches of any two instances of a matrix target have the same outputs in the same work dir,
+// which they would overwrite, and store in each other's cache entries
+func sharedOutputs(instances []Target) bool {
+	seen := map[string]bool{}
+	for _, instance := range instances {
+		if instance.Caches == nil {
+			continue
+		}
+		workDir := ""
+		if instance.WorkDir != nil {
+			workDir = *instance.WorkDir
+		}
+		for i, cache := range *instance.Caches {
+			if len(cache.Outputs) == 0 {
+				continue
+			}
+			key := strconv.Itoa(i) + "\x00" + workDir + "\x00" + strings.Join(cache.Outputs, "\x00")
+			if seen[key] {
+				return true
+			}
+			seen[key] = true
+		}
+	}
+	return false
+}
+
+// expandMatrix replaces each target with a matrix by a target per combination of its values, which get the values as
+// MATRIX_<KEY> environment variables, also expanded in the work dir and cache paths of the target.
+// Depending on, or running the target in a plan, means all of its combinations.
+func expandMatrix(c *Config) error {
+	groups := map[string][]string{}
+	var targets []Target
+	for _, target := range c.Targets {
+		if target.Matrix == nil {
+			targets = append(targets, target)
+			continue
+		}
+		if len(target.Matrix) == 0 {
+			return fmt.Errorf("the matrix of the target %v is empty", target.Name)
+		}
+		for key, values := range target.Matrix {
+			if len(values) == 0 {
+				return fmt.Errorf("the matrix of the target %v has no values for %v", target.Name, key)
+			}
+		}
+		var instances []Target
+		for _, combination := range matrixCombinations(target.Matrix) {
+			instance := target
+			instance.Name = matrixName(target.Name, combination)
+			instance.Matrix = nil
+			instance.matrixEnv = map[string]string{}
+			for key, value := range combination {
+				instance.matrixEnv[matrixEnv(key)] = value
+			}
+			expandMatrixPaths(&instance)
+			groups[target.Name] = append(groups[target.Name], instance.Name)
+			instances = append(instances, instance)
+		}
+		if sharedOutputs(instances) {
+			return fmt.Errorf("the combinations of the matrix target %v share the outputs of its caches, "+
+				"which must depend on the matrix values, such as dist/$MATRIX_<KEY>, or be in a work_dir which does", target.Name)
+		}
+		targets = append(targets, instances...)
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+	expand := func(names []string) []string {
+		var expanded []string
+		for _, name := range names {
+			instances, isGroup := groups[name]
+			if !isGroup {
+				instances = []string{name}
+			}
+			expanded = append(expanded, instances...)
+		}
+		return expanded
+	}
+	for i, target := range targets {
+		if target.DependsOn != nil {
+			dependsOn := expand(*target.DependsOn)
+			targets[i].DependsOn = &dependsOn
+		}
+	}
+	for i, plan := range c.ExecutionPlans {
+		c.ExecutionPlans[i].Targets = expand(plan.Targets)
+	}
+	c.Targets = targets
+	return nil
+}
@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// Output modes, determining how the output of targets running in parallel is printed
+const (
+	// Each line is printed as soon as it is complete, prefixed with the name of its target
+	OutputInterleaved = "interleaved"
+	// The output of each target is printed at once when it finishes
+	OutputGrouped = "grouped"
+	// A table of the state of each target is redrawn in place, with the last line of output of running targets
+	OutputLive = "live"
+)
+
+// RunOptions configures how a plan is run
+type RunOptions struct {
+	// interleaved (default) or grouped
+	Output string
+	// Directory to write the full log of each target to, as <target>.log
+	LogDir *string
+	// Targets restored from the cache, which are not run
+	Cached map[string]CacheHit
+	// Targets whose when condition is not met, which are skipped
+	Unmet map[string]bool
+	// Hooks of the plan, run after all targets have finished
+	PlanHooks *Target
+	// Cancelled is polled while a target runs, which is killed once it returns true
+	Cancelled func(target string) bool
+	// Stdout receives the output of targets in interleaved and grouped mode, os.Stdout if nil.
+	// With json logs, it is os.Stderr, so stdout holds log messages only.
+	Stdout io.Writer
+	// The live display of the run, in live mode
+	display *liveDisplay
+	// The targets depending on each service, which is stopped once they have finished
+	dependents map[string]map[string]bool
+}
+
+func (options RunOptions) stdout() io.Writer {
+	if options.Stdout == nil {
+		return os.Stdout
+	}
+	return options.Stdout
+}
+
+// LogDir returns the directory the logs of a run are written to
+func LogDir(rootDir *string, runID string) string {
+	return prependPath(rootDir, filepath.Join(".gbuild_cache", "logs", runID))
+}
+
+// consoleLock keeps lines and groups of output of different targets from being mixed up
+var consoleLock sync.Mutex
+
+var colors = []string{"\033[36m", "\033[32m", "\033[33m", "\033[34m", "\033[35m", "\033[96m", "\033[92m", "\033[93m", "\033[94m", "\033[95m"}
+
+const resetColor = "\033[0m"
+
+// useColor is true if stdout is a terminal, and colors are not disabled with $NO_COLOR
+func useColor() bool {
+	_, noColor := os.LookupEnv("NO_COLOR")
+	return !noColor && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// tag returns [name], colored by the name of the target, so each target keeps its color between runs
+func tag(name string, color bool) string {
+	if !color {
+		return "[" + name + "]"
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return colors[hash.Sum32()%uint32(len(colors))] + "[" + name + "]" + resetColor
+}
+
+// A targetOutput captures the stdout and stderr of a target, writing it to its log file and the console
+type targetOutput struct {
+	name    string
+	mode    string
+	logFile *os.File
+	console io.Writer
+	group   bytes.Buffer
+	stdout  *lineWriter
+	stderr  *lineWriter
+	// stdout and stderr along with the log file
+	stdoutWriter io.Writer
+	stderrWriter io.Writer
+	display      *liveDisplay
+	closed       bool
+}
+
+func newTargetOutput(target Target, options RunOptions) (*targetOutput, error) {
+	output := &targetOutput{name: target.Name, mode: options.Output, console: options.stdout()}
+	if output.mode == "" {
+		output.mode = OutputInterleaved
+	}
+	if options.LogDir != nil {
+		err := os.MkdirAll(*options.LogDir, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+		fileName := strings.NewReplacer("/", "_", string(os.PathSeparator), "_").Replace(target.Name) + ".log"
+		output.logFile, err = os.OpenFile(filepath.Join(*options.LogDir, fileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if output.mode == OutputGrouped {
+		output.stdout = &lineWriter{out: &output.group}
+		output.stderr = output.stdout
+	} else if output.mode == OutputLive && options.display != nil {
+		output.display = options.display
+		output.stdout = &lineWriter{out: &lastLineWriter{options.display, target.Name}}
+		output.stderr = output.stdout
+	} else {
+		prefix := tag(target.Name, useColor()) + " "
+		output.stdout = &lineWriter{out: output.console, prefix: prefix}
+		output.stderr = &lineWriter{out: os.Stderr, prefix: prefix}
+	}
+	output.stdoutWriter = output.writer(output.stdout)
+	output.stderrWriter = output.stdoutWriter
+	if output.stderr != output.stdout {
+		output.stderrWriter = output.writer(output.stderr)
+	}
+	return output, nil
+}
+
+func (output *targetOutput) Stdout() io.Writer {
+	return output.stdoutWriter
+}
+
+// Stderr is the same writer as Stdout if they go to the same console, so a command writes both through one pipe,
+// keeping them in order
+func (output *targetOutput) Stderr() io.Writer {
+	return output.stderrWriter
+}
+
+func (output *targetOutput) writer(console *lineWriter) io.Writer {
+	if output.logFile == nil {
+		return console
+	}
+	return io.MultiWriter(output.logFile, console)
+}
+
+// attempt shows the target as running in the live display, if any
+func (output *targetOutput) attempt(attempt int) {
+	if output.display != nil {
+		output.display.attempt(output.name, attempt)
+	}
+}
+
+// LogFile returns the path of the log file of the target, if any
+func (output *targetOutput) LogFile() *string {
+	if output.logFile == nil {
+		return nil
+	}
+	return String(output.logFile.Name())
+}
+
+// Close prints any incomplete last line, or the whole output of the target in grouped mode
+func (output *targetOutput) Close() error {
+	if output.closed {
+		return nil
+	}
+	output.closed = true
+	output.stdout.flush()
+	output.stderr.flush()
+	if output.mode == OutputGrouped && output.group.Len() > 0 {
+		consoleLock.Lock()
+		fmt.Fprintf(output.console, "%v\n%v", tag(output.name, useColor()), output.group.String())
+		consoleLock.Unlock()
+	}
+	if output.logFile != nil {
+		return output.logFile.Close()
+	}
+	return nil
+}
+
+// A lineWriter writes whole lines, each with the prefix, holding back incomplete lines until they are complete
+type lineWriter struct {
+	out     io.Writer
+	prefix  string
+	lock    sync.Mutex
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.partial = append(w.partial, p...)
+	end := bytes.LastIndexByte(w.partial, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+	var lines bytes.Buffer
+	for _, line := range bytes.SplitAfter(w.partial[:end+1], []byte("\n")) {
+		if len(line) > 0 {
+			lines.WriteString(w.prefix)
+			lines.Write(line)
+		}
+	}
+	w.partial = append([]byte{}, w.partial[end+1:]...)
+	consoleLock.Lock()
+	defer consoleLock.Unlock()
+	_, err := w.out.Write(lines.Bytes())
+	return len(p), err
+}
+
+func (w *lineWriter) flush() {
+	w.lock.Lock()
+	partial := w.partial
+	w.lock.Unlock()
+	if len(partial) > 0 {
+		w.Write([]byte("\n"))
+	}
+}
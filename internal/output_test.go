@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestLineWriterPrefixesWholeLines(t *testing.T) {
+	var out bytes.Buffer
+	w := &lineWriter{out: &out, prefix: "[foo] "}
+	w.Write([]byte("one\ntw"))
+	w.Write([]byte("o\nthree"))
+	if out.String() != "[foo] one\n[foo] two\n" {
+		t.Fatalf("Expected incomplete lines to be held back, got %q", out.String())
+	}
+	w.flush()
+	if out.String() != "[foo] one\n[foo] two\n[foo] three\n" {
+		t.Fatalf("Expected the last line to be flushed, got %q", out.String())
+	}
+}
+
+func TestTargetLogsAreWritten(t *testing.T) {
+	dir := t.TempDir()
+	targets := []Target{
+		// in interleaved mode, stdout and stderr are read from pipes of their own, so their order is only kept apart in time
+		{Name: "foo", Run: "echo out\nsleep 0.1\necho err >&2"},
+	}
+
+	for _, mode := range []string{OutputInterleaved, OutputGrouped} {
+		res, err := RunPlanWithOptions(targets, l, RunOptions{Output: mode, LogDir: String(dir + "/" + mode)})
+		if err != nil {
+			t.Fatalf("Did not expect error %v", err)
+		}
+		if res[0].LogFile == nil {
+			t.Fatal("Expected the result to have a log file")
+		}
+		buf, err := ioutil.ReadFile(*res[0].LogFile)
+		if err != nil {
+			t.Fatalf("Did not expect error %v", err)
+		}
+		if string(buf) != "out\nerr\n" {
+			t.Fatalf("Expected the full output in the log file, got %q", string(buf))
+		}
+	}
+}
+
+func TestTargetOutputGoesToStdout(t *testing.T) {
+	targets := []Target{
+		{Name: "foo", Run: "echo out"},
+	}
+
+	for _, mode := range []string{OutputInterleaved, OutputGrouped} {
+		var out bytes.Buffer
+		_, err := RunPlanWithOptions(targets, l, RunOptions{Output: mode, Stdout: &out})
+		if err != nil {
+			t.Fatalf("Did not expect error %v", err)
+		}
+		if !bytes.Contains(out.Bytes(), []byte("out\n")) {
+			t.Fatalf("Expected the output of foo to go to the given stdout in %v mode, got %q", mode, out.String())
+		}
+	}
+}
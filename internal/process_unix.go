@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package internal
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// startProcessGroup runs the command in a process group of its own, so killProcess reaches the processes it starts
+func startProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcess kills the process group of the command, so no child holds on to its output after it is killed
+func killProcess(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// terminateProcess asks the process group of the command to stop, giving it the chance to clean up
+func terminateProcess(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
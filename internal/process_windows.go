@@ -0,0 +1,18 @@
+package internal
+
+import "os/exec"
+
+// process groups are not used on windows, where killing a process does not kill its children
+func startProcessGroup(cmd *exec.Cmd) {}
+
+func killProcess(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
+
+// processes can not be asked to stop on windows, so they are killed
+func terminateProcess(cmd *exec.Cmd) error {
+	return killProcess(cmd)
+}
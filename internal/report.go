@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// ReportSchemaVersion is incremented on changes to the report which are not backwards compatible
+const ReportSchemaVersion = 1
+
+// A Report describes a run of an execution plan, as written by --report
+type Report struct {
+	SchemaVersion   int            `json:"schema_version"`
+	Plan            string         `json:"plan"`
+	GitRevision     *string        `json:"git_revision"`
+	Started         time.Time      `json:"started"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Success         bool           `json:"success"`
+	Targets         []TargetReport `json:"targets"`
+}
+
+// A TargetReport describes the result of a target in a Report
+type TargetReport struct {
+	Name           string  `json:"name"`
+	Status         string  `json:"status"`
+	Attempts       int     `json:"attempts"`
+	WaitSeconds    float64 `json:"wait_seconds"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	ExitCode       *int    `json:"exit_code"`
+	CacheKey       *string `json:"cache_key"`
+	CacheSource    *string `json:"cache_source"`
+	LogFile        *string `json:"log_file"`
+	Error          *string `json:"error"`
+	AllowedFailure bool    `json:"allowed_failure"`
+	ConditionUnmet bool    `json:"condition_unmet"`
+}
+
+// NewReport describes the results of the targets of a plan, in the order of the targets
+func NewReport(plan string, gitRevision *string, started time.Time, duration time.Duration, targets []Target, results []TargetResult, err error) Report {
+	report := Report{
+		SchemaVersion:   ReportSchemaVersion,
+		Plan:            plan,
+		GitRevision:     gitRevision,
+		Started:         started,
+		DurationSeconds: duration.Seconds(),
+		Success:         err == nil,
+		Targets:         []TargetReport{},
+	}
+	for _, target := range targets {
+		for _, result := range results {
+			if result.Target.Name == target.Name {
+				report.Targets = append(report.Targets, newTargetReport(result))
+				break
+			}
+		}
+	}
+	return report
+}
+
+func newTargetReport(result TargetResult) TargetReport {
+	target := TargetReport{
+		Name:           result.Target.Name,
+		Status:         result.Status,
+		Attempts:       result.Attempts,
+		ElapsedSeconds: result.Elapsed.Seconds(),
+		ExitCode:       result.ExitCode,
+		LogFile:        result.LogFile,
+		AllowedFailure: result.AllowedFailure,
+		ConditionUnmet: result.ConditionUnmet,
+	}
+	if result.Wait != nil {
+		target.WaitSeconds = result.Wait.Seconds()
+	}
+	if result.CacheKey != "" {
+		target.CacheKey = String(result.CacheKey)
+		target.CacheSource = String(result.CacheSource)
+	}
+	if result.Err != nil {
+		target.Error = String((*result.Err).Error())
+	}
+	return target
+}
+
+// WriteReport writes the report to file as indented JSON
+func WriteReport(file string, report Report) error {
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(buf, '\n'), 0644)
+}
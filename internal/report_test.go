@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	err := errors.New("exit status 1")
+	wait := time.Second
+	targets := []Target{{Name: "foo"}, {Name: "bar"}}
+	results := []TargetResult{
+		{Target: Target{Name: "bar"}, Status: StatusFailed, Err: &err, Attempts: 2, ExitCode: Int(1), Wait: &wait, Elapsed: 3 * time.Second},
+		{Target: Target{Name: "foo"}, Status: StatusCached, CacheKey: "abc", CacheSource: CacheSourceRemote},
+	}
+	file := filepath.Join(t.TempDir(), "run.json")
+	report := NewReport("build", String("deadbeef"), time.Now(), 5*time.Second, targets, results, err)
+	err = WriteReport(file, report)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	read := Report{}
+	err = json.Unmarshal(buf, &read)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if read.SchemaVersion != ReportSchemaVersion || read.Plan != "build" || read.Success || *read.GitRevision != "deadbeef" {
+		t.Fatalf("Unexpected report %+v", read)
+	}
+	if len(read.Targets) != 2 || read.Targets[0].Name != "foo" || read.Targets[1].Name != "bar" {
+		t.Fatalf("Expected targets in plan order, got %+v", read.Targets)
+	}
+	if foo := read.Targets[0]; *foo.CacheKey != "abc" || *foo.CacheSource != CacheSourceRemote || foo.ExitCode != nil {
+		t.Fatalf("Unexpected cached target %+v", foo)
+	}
+	if bar := read.Targets[1]; bar.Status != StatusFailed || *bar.ExitCode != 1 || bar.Attempts != 2 || bar.WaitSeconds != 1 || *bar.Error != "exit status 1" {
+		t.Fatalf("Unexpected failed target %+v", bar)
+	}
+}
@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// serviceStopTimeout is how long a service is given to stop, before it is killed
+const serviceStopTimeout = 10 * time.Second
+
+func validateService(target Target) error {
+	if !target.Service {
+		if target.ReadyCheck != nil {
+			return fmt.Errorf("the target %v has a ready_check, but is not a service", target.Name)
+		}
+		return nil
+	}
+	check := target.ReadyCheck
+	if check == nil {
+		return fmt.Errorf("the service %v must have a ready_check", target.Name)
+	}
+	kinds := 0
+	for _, set := range []bool{check.Command != nil, check.TCP != nil, check.HTTP != nil} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("the ready_check of the service %v must have exactly one of command, tcp or http", target.Name)
+	}
+	if target.Caches != nil && len(*target.Caches) > 0 {
+		return fmt.Errorf("the service %v can not have caches", target.Name)
+	}
+	for _, duration := range []*string{check.Interval, check.Timeout} {
+		if duration != nil {
+			if _, err := time.ParseDuration(*duration); err != nil {
+				return fmt.Errorf("invalid ready_check of the service %v: %v", target.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (check *ReadyCheck) interval() time.Duration {
+	return parseDurationOr(check.Interval, 500*time.Millisecond)
+}
+
+func (check *ReadyCheck) timeout() time.Duration {
+	return parseDurationOr(check.Timeout, 60*time.Second)
+}
+
+func parseDurationOr(duration *string, fallback time.Duration) time.Duration {
+	if duration == nil {
+		return fallback
+	}
+	d, err := time.ParseDuration(*duration)
+	if err != nil {
+		return fallback
+	}
+	return d
+}
+
+// ready runs the check once, returning an error if the service is not ready
+func (check *ReadyCheck) ready(target Target) error {
+	switch {
+	case check.TCP != nil:
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("localhost", strconv.Itoa(*check.TCP)), check.interval())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case check.HTTP != nil:
+		client := http.Client{Timeout: check.interval()}
+		resp, err := client.Get(*check.HTTP)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%v responded with %v", *check.HTTP, resp.Status)
+		}
+		return nil
+	default:
+		cmd := targetCommand(Target{Run: *check.Command, Shell: target.Shell})
+		if target.WorkDir != nil {
+			cmd.Dir = *target.WorkDir
+		}
+		cmd.Env = target.commandEnv()
+		startProcessGroup(cmd)
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		// a check which hangs is killed once it is due to run again
+		timer := time.AfterFunc(check.interval(), func() { killProcess(cmd) })
+		defer timer.Stop()
+		return cmd.Wait()
+	}
+}
+
+// serviceDependents returns the targets depending on each service, directly or indirectly
+func serviceDependents(targets []Target) map[string]map[string]bool {
+	dependents := map[string]map[string]bool{}
+	for _, target := range targets {
+		if target.Service {
+			affected := affectedTargets(targets, map[string]bool{target.Name: true})
+			delete(affected, target.Name)
+			dependents[target.Name] = affected
+		}
+	}
+	return dependents
+}
+
+// runService starts a service, and writes its result once its ready check succeeds, so its dependents can start.
+// It is stopped once all its dependents have finished, or a target fails. If it exits before its dependents have finished,
+// its result is replaced by a failure, which cancels them.
+func runService(target Target, waitGroup *sync.WaitGroup, reads chan readOp, writes chan TargetResult, log Log, options RunOptions,
+	start time.Time, output *targetOutput) {
+	attemptStart := time.Now()
+	waitTime := attemptStart.Sub(start)
+	result := func(status string, err error) {
+		r := TargetResult{Target: target, Wait: &waitTime, Elapsed: time.Since(start), LogFile: output.LogFile(),
+			Status: status, Attempts: 1, Scheduled: start, Runs: []Span{{attemptStart, time.Now()}}}
+		if err != nil {
+			r.Err = &err
+			r.ExitCode = exitCode(err)
+		}
+		writes <- r
+	}
+	// finish runs the hooks of the service, once it has stopped
+	finish := func(status string, err error) {
+		runHooks(target, status, target.Name, exitCode(err), output.Stdout(), output.Stderr(), log)
+		output.Close()
+	}
+	fail := func(status string, err error) {
+		finish(status, err)
+		result(status, err)
+		waitGroup.Done()
+		waitGroup.Done()
+	}
+
+	output.attempt(1)
+	log.Info("Service starting", F("target", target.Name), F("wait", waitTime))
+	cmd := targetCommand(target)
+	cmd.Stdout = output.Stdout()
+	cmd.Stderr = output.Stderr()
+	if target.WorkDir != nil {
+		cmd.Dir = *target.WorkDir
+	}
+	cmd.Env = target.commandEnv()
+	startProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		log.Error("Service failed to start", F("target", target.Name), F("error", err))
+		fail(StatusFailed, err)
+		return
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	stop := func() {
+		terminateProcess(cmd)
+		select {
+		case <-exited:
+		case <-time.After(serviceStopTimeout):
+			killProcess(cmd)
+			<-exited
+		}
+	}
+
+	read := readOp{
+		resp: make(chan []TargetResult),
+	}
+	defer close(read.resp)
+	// state returns whether the plan failed or the service was cancelled, and whether all its dependents have finished
+	state := func() (bool, bool) {
+		reads <- read
+		resp := <-read.resp
+		finished := 0
+		for _, t := range resp {
+			if options.dependents[target.Name][t.Target.Name] {
+				finished++
+			}
+		}
+		cancelled := failed(resp) || (options.Cancelled != nil && options.Cancelled(target.Name))
+		return cancelled, finished == len(options.dependents[target.Name])
+	}
+
+	check := target.ReadyCheck
+	deadline := time.Now().Add(check.timeout())
+	for {
+		err := check.ready(target)
+		if err == nil {
+			break
+		}
+		if cancelled, _ := state(); cancelled {
+			stop()
+			log.Warn("Service cancelled before it was ready", F("target", target.Name))
+			fail(StatusCancelled, errors.New("cancelled before it was ready"))
+			return
+		}
+		if time.Now().After(deadline) {
+			stop()
+			log.Error("Service was not ready in time", F("target", target.Name), F("timeout", check.timeout()), F("error", err))
+			fail(StatusFailed, fmt.Errorf("not ready within %v: %v", check.timeout(), err))
+			return
+		}
+		select {
+		case err := <-exited:
+			if err == nil {
+				err = errors.New("exited before it was ready")
+			}
+			log.Error("Service exited before it was ready", F("target", target.Name), F("error", err))
+			fail(StatusFailed, err)
+			return
+		case <-time.After(check.interval()):
+		}
+	}
+	log.Info("Service ready", F("target", target.Name), F("duration", time.Since(attemptStart)))
+	result(StatusSuccess, nil)
+	waitGroup.Done()
+
+	for {
+		if cancelled, done := state(); cancelled || done {
+			break
+		}
+		select {
+		case err := <-exited:
+			if _, done := state(); done {
+				finish(StatusSuccess, nil)
+				log.Info("Service stopped", F("target", target.Name), F("duration", time.Since(attemptStart)))
+				waitGroup.Done()
+				return
+			}
+			if err == nil {
+				err = errors.New("exited before its dependents finished")
+			}
+			log.Error("Service exited before its dependents finished", F("target", target.Name), F("error", err))
+			finish(StatusFailed, err)
+			result(StatusFailed, err)
+			waitGroup.Done()
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	stop()
+	finish(StatusSuccess, nil)
+	log.Info("Service stopped", F("target", target.Name), F("duration", time.Since(attemptStart)))
+	waitGroup.Done()
+}
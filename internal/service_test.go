@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serviceRun starts a service which writes a file when it is stopped
+const serviceRun = `trap 'echo stopped > $DIR/stopped; exit 0' TERM; touch $DIR/ready; while true; do sleep 0.1; done`
+
+func TestServiceIsStoppedAfterItsDependents(t *testing.T) {
+	dir := t.TempDir()
+	env := map[string]string{"DIR": dir}
+	targets := []Target{
+		{Name: "db", Service: true, Run: serviceRun, Env: env, ReadyCheck: &ReadyCheck{Command: String("test -f $DIR/ready"), Interval: String("50ms")}},
+		{Name: "migrate", Run: "test -f $DIR/ready && test ! -f $DIR/stopped", Env: env, DependsOn: &[]string{"db"}},
+		{Name: "test", Run: "sleep 0.2 && test ! -f $DIR/stopped", Env: env, DependsOn: &[]string{"migrate"}},
+	}
+	res, err := RunPlan(targets, l)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if len(res) != 3 {
+		t.Fatalf("Expected 3 results, got %v", res)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(dir, "stopped")); err != nil || string(buf) != "stopped\n" {
+		t.Fatalf("Expected the service to be stopped at the end of the plan, got %v", err)
+	}
+}
+
+func TestServiceIsStoppedOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	env := map[string]string{"DIR": dir}
+	targets := []Target{
+		{Name: "db", Service: true, Run: serviceRun, Env: env, ReadyCheck: &ReadyCheck{Command: String("test -f $DIR/ready"), Interval: String("50ms")}},
+		{Name: "fails", Run: "exit 1", DependsOn: &[]string{"db"}},
+		{Name: "slow", Run: "sleep 10", DependsOn: &[]string{"db"}},
+	}
+	start := time.Now()
+	_, err := RunPlan(targets, l)
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("Expected the plan to be cancelled")
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "stopped")); err != nil {
+		t.Fatalf("Expected the service to be stopped, got %v", err)
+	}
+}
+
+func TestServiceReadyChecks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	for _, check := range []*ReadyCheck{{HTTP: String(server.URL)}, {TCP: &port}} {
+		targets := []Target{
+			{Name: "service", Service: true, Run: "sleep 10", ReadyCheck: check},
+			{Name: "dependent", Run: "cd .", DependsOn: &[]string{"service"}},
+		}
+		start := time.Now()
+		_, err := RunPlan(targets, l)
+		if err != nil {
+			t.Fatalf("Did not expect error %v", err)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Expected the service to be stopped once its dependent finished")
+		}
+	}
+}
+
+func TestServiceNotReadyInTime(t *testing.T) {
+	targets := []Target{
+		{Name: "service", Service: true, Run: "sleep 10", ReadyCheck: &ReadyCheck{Command: String("false"), Interval: String("50ms"), Timeout: String("200ms")}},
+		{Name: "dependent", Run: "cd .", DependsOn: &[]string{"service"}},
+	}
+	res, err := RunPlan(targets, l)
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+	for _, r := range res {
+		if r.Target.Name == "service" && r.Status != StatusFailed {
+			t.Fatalf("Expected the service to fail, got %v", r.Status)
+		}
+		if r.Target.Name == "dependent" && r.Status != StatusSkipped {
+			t.Fatalf("Expected the dependent to be skipped, got %v", r.Status)
+		}
+	}
+}
+
+func TestServiceValidation(t *testing.T) {
+	for _, target := range []Target{
+		{Name: "a", Run: "cd .", Service: true},
+		{Name: "a", Run: "cd .", Service: true, ReadyCheck: &ReadyCheck{}},
+		{Name: "a", Run: "cd .", Service: true, ReadyCheck: &ReadyCheck{TCP: Int(80), HTTP: String("http://localhost")}},
+		{Name: "a", Run: "cd .", Service: true, ReadyCheck: &ReadyCheck{TCP: Int(80), Timeout: String("soon")}},
+		{Name: "a", Run: "cd .", ReadyCheck: &ReadyCheck{TCP: Int(80)}},
+	} {
+		if err := validate(&Config{Targets: []Target{target}}, l); err == nil {
+			t.Fatalf("Expected an error for %+v but got none", target)
+		}
+	}
+}
+
+func TestServiceExitingEarlyFails(t *testing.T) {
+	targets := []Target{
+		{Name: "db", Service: true, Run: "sleep 0.3", ReadyCheck: &ReadyCheck{Command: String("true"), Interval: String("50ms")}},
+		{Name: "test", Run: "sleep 10", DependsOn: &[]string{"db"}},
+	}
+	start := time.Now()
+	res, err := RunPlan(targets, l)
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("Expected the dependents of the service to be cancelled")
+	}
+	for _, r := range res {
+		if r.Target.Name == "db" && r.Status != StatusFailed {
+			t.Fatalf("Expected db to fail, got %v", r.Status)
+		}
+		if r.Target.Name == "test" && r.Status != StatusCancelled {
+			t.Fatalf("Expected test to be cancelled, got %v", r.Status)
+		}
+	}
+}
+
+func TestServiceHooks(t *testing.T) {
+	dir := t.TempDir()
+	env := map[string]string{"DIR": dir}
+	hooks := Hooks{OnFailure: String(`echo "$GBUILD_FAILED_TARGET" > $DIR/failed`), Always: String(`echo $GBUILD_STATUS >> $DIR/always`)}
+	targets := []Target{
+		{Name: "db", Service: true, Run: "sleep 10", Env: env, Hooks: hooks, ReadyCheck: &ReadyCheck{Command: String("true"), Interval: String("50ms")}},
+		{Name: "test", Run: "cd .", DependsOn: &[]string{"db"}},
+	}
+	_, err := RunPlan(targets, l)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if buf, _ := ioutil.ReadFile(filepath.Join(dir, "always")); string(buf) != "success\n" {
+		t.Fatalf("Expected always to run once the service stopped, got %q", string(buf))
+	}
+
+	// the service exits before its dependent finished
+	targets[0].Run = "sleep 0.3"
+	targets[1].Run = "sleep 10"
+	_, err = RunPlan(targets, l)
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+	if buf, _ := ioutil.ReadFile(filepath.Join(dir, "failed")); string(buf) != "db\n" {
+		t.Fatalf("Expected on_failure to run once the service exited, got %q", string(buf))
+	}
+	if buf, _ := ioutil.ReadFile(filepath.Join(dir, "always")); string(buf) != "success\nfailed\n" {
+		t.Fatalf("Expected always to run once the service exited, got %q", string(buf))
+	}
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+const defaultKeyEnv = "GBUILD_CACHE_KEY"
+
+// A signer signs and verifies cache entries and index entries, so restored outputs can be trusted
+type signer interface {
+	sign(message []byte) (string, error)
+	verify(message []byte, signature string) bool
+}
+
+type hmacSigner struct {
+	key []byte
+}
+
+// ed25519 signers may hold only a public key, in which case they can verify, but not sign
+type ed25519Signer struct {
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+func (s hmacSigner) sign(message []byte) (string, error) {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(message)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (s hmacSigner) verify(message []byte, signature string) bool {
+	expected, _ := s.sign(message)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+func (s ed25519Signer) sign(message []byte) (string, error) {
+	if s.private == nil {
+		return "", errors.New("cannot sign cache entries with only an ed25519 public key")
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(s.private, message)), nil
+}
+
+func (s ed25519Signer) verify(message []byte, signature string) bool {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	return err == nil && ed25519.Verify(s.public, message, sig)
+}
+
+// newSigner returns the signer described by the cache config, or nil if signing is not configured
+func newSigner(config *CacheConfig) (signer, error) {
+	if config == nil || config.Signing == nil {
+		return nil, nil
+	}
+	signing := config.Signing
+	keyEnv := defaultKeyEnv
+	if signing.KeyEnv != nil {
+		keyEnv = *signing.KeyEnv
+	}
+	key := os.Getenv(keyEnv)
+
+	algorithm := "hmac"
+	if signing.Algorithm != nil {
+		algorithm = *signing.Algorithm
+	}
+	switch algorithm {
+	case "hmac":
+		if key == "" {
+			return nil, fmt.Errorf("cache signing is configured, but $%v is not set", keyEnv)
+		}
+		return hmacSigner{[]byte(key)}, nil
+	case "ed25519":
+		s := ed25519Signer{}
+		if key != "" {
+			buf, err := base64.StdEncoding.DecodeString(key)
+			if err != nil {
+				return nil, fmt.Errorf("$%v is not a base64 encoded ed25519 key: %v", keyEnv, err)
+			}
+			switch len(buf) {
+			case ed25519.SeedSize:
+				s.private = ed25519.NewKeyFromSeed(buf)
+			case ed25519.PrivateKeySize:
+				s.private = ed25519.PrivateKey(buf)
+			default:
+				return nil, fmt.Errorf("$%v is not an ed25519 private key or seed", keyEnv)
+			}
+			s.public = s.private.Public().(ed25519.PublicKey)
+		}
+		if signing.PublicKey != nil {
+			buf, err := base64.StdEncoding.DecodeString(*signing.PublicKey)
+			if err != nil || len(buf) != ed25519.PublicKeySize {
+				return nil, errors.New("public_key is not a base64 encoded ed25519 public key")
+			}
+			s.public = ed25519.PublicKey(buf)
+		}
+		if s.public == nil {
+			return nil, fmt.Errorf("cache signing is configured, but neither $%v nor public_key is set", keyEnv)
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown cache signing algorithm %v, must be hmac or ed25519", algorithm)
+	}
+}
+
+// entryMessage is what is signed for a cache entry, binding its hash to the digest of its contents,
+// and to the $GBUILD_OUTPUT values of its target, if it has any
+func entryMessage(hash string, digest string, outputs map[string]string) []byte {
+	message := "gbuild-entry\n" + hash + "\n" + digest
+	var keys []string
+	for key := range outputs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		message += "\n" + key + "=" + outputs[key]
+	}
+	return []byte(message)
+}
+
+// indexMessage is what is signed for an index entry, binding an input hash or git revision to a cache entry
+func indexMessage(key string, hash string) []byte {
+	return []byte("gbuild-index\n" + key + "\n" + hash)
+}
+
+func digest(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
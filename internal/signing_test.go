@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"testing"
+)
+
+func TestHMACSigner(t *testing.T) {
+	os.Setenv("GBUILD_TEST_KEY", "secret")
+	defer os.Unsetenv("GBUILD_TEST_KEY")
+	s, err := newSigner(&CacheConfig{Signing: &SigningConfig{KeyEnv: String("GBUILD_TEST_KEY")}})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	signature, err := s.sign(entryMessage("foo", "bar", nil))
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if !s.verify(entryMessage("foo", "bar", nil), signature) {
+		t.Fatal("Expected signature to verify")
+	}
+	if s.verify(entryMessage("foo", "baz", nil), signature) || s.verify(indexMessage("foo", "bar"), signature) {
+		t.Fatal("Expected signature not to verify for a different message")
+	}
+}
+
+func TestMissingKey(t *testing.T) {
+	_, err := newSigner(&CacheConfig{Signing: &SigningConfig{KeyEnv: String("GBUILD_TEST_NOT_SET")}})
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+}
+
+func TestEd25519Signer(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	os.Setenv("GBUILD_TEST_KEY", base64.StdEncoding.EncodeToString(private.Seed()))
+	defer os.Unsetenv("GBUILD_TEST_KEY")
+	s, err := newSigner(&CacheConfig{Signing: &SigningConfig{Algorithm: String("ed25519"), KeyEnv: String("GBUILD_TEST_KEY")}})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	signature, err := s.sign(entryMessage("foo", "bar", nil))
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+
+	// e.g. builds of forks, which only have the public key
+	publicKey := base64.StdEncoding.EncodeToString(public)
+	verifier, err := newSigner(&CacheConfig{Signing: &SigningConfig{Algorithm: String("ed25519"), KeyEnv: String("GBUILD_TEST_NOT_SET"), PublicKey: &publicKey}})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if !verifier.verify(entryMessage("foo", "bar", nil), signature) {
+		t.Fatal("Expected signature to verify with the public key")
+	}
+	if verifier.verify(entryMessage("foo", "baz", nil), signature) {
+		t.Fatal("Expected signature not to verify for a different message")
+	}
+	_, err = verifier.sign(entryMessage("foo", "bar", nil))
+	if err == nil {
+		t.Fatal("Expected an error signing with only a public key")
+	}
+}
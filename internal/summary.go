@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Summary describes where the time of a run went
+type Summary struct {
+	// The chain of targets which determined the total wall time, each waiting on the one before it
+	CriticalPath []PathStep
+	// The time spent running targets, divided by the wall time of the run
+	Parallelism float64
+}
+
+// A PathStep is a target on the critical path, with the time it added to the path:
+// from the end of the target before it, or the start of the run, to its own end
+type PathStep struct {
+	Target   string
+	Duration time.Duration
+}
+
+// span is the time from the start of the first attempt of the target to the end of its last attempt, if it ran
+func (result TargetResult) span() (Span, bool) {
+	if len(result.Runs) == 0 {
+		return Span{}, false
+	}
+	return Span{result.Runs[0].Start, result.Runs[len(result.Runs)-1].End}, true
+}
+
+// Summarize finds the critical path through the targets which ran, which ends at the target finishing last,
+// and leads back through the dependency of each target finishing last, so holding up its start the longest
+func Summarize(results []TargetResult, started time.Time, duration time.Duration) Summary {
+	summary := Summary{}
+	spans := map[string]Span{}
+	byName := map[string]TargetResult{}
+	var busy time.Duration
+	var last *TargetResult
+	for i, result := range results {
+		span, ran := result.span()
+		if !ran {
+			continue
+		}
+		for _, run := range result.Runs {
+			busy += run.Duration()
+		}
+		spans[result.Target.Name] = span
+		byName[result.Target.Name] = result
+		if last == nil || span.End.After(spans[last.Target.Name].End) {
+			last = &results[i]
+		}
+	}
+	if duration > 0 {
+		summary.Parallelism = busy.Seconds() / duration.Seconds()
+	}
+
+	var path []string
+	for current := last; current != nil; {
+		path = append([]string{current.Target.Name}, path...)
+		var previous *TargetResult
+		if current.Target.DependsOn != nil {
+			for _, dependency := range *current.Target.DependsOn {
+				result, ran := byName[dependency]
+				if ran && (previous == nil || spans[dependency].End.After(spans[previous.Target.Name].End)) {
+					previous = &result
+				}
+			}
+		}
+		current = previous
+	}
+	from := started
+	for _, name := range path {
+		summary.CriticalPath = append(summary.CriticalPath, PathStep{name, spans[name].End.Sub(from)})
+		from = spans[name].End
+	}
+	return summary
+}
+
+// Path returns the names of the targets on the critical path, joined by arrows
+func (summary Summary) Path() string {
+	var names []string
+	for _, step := range summary.CriticalPath {
+		names = append(names, step.Target)
+	}
+	return strings.Join(names, " -> ")
+}
+
+// TopTargets returns at most n of the targets on the critical path, by the time they added to it
+func (summary Summary) TopTargets(n int) []PathStep {
+	steps := append([]PathStep{}, summary.CriticalPath...)
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].Duration > steps[j].Duration })
+	if len(steps) > n {
+		steps = steps[:n]
+	}
+	return steps
+}
@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	started := time.Now()
+	at := func(seconds int) time.Time {
+		return started.Add(time.Duration(seconds) * time.Second)
+	}
+	results := []TargetResult{
+		{Target: Target{Name: "deploy", DependsOn: &[]string{"test", "lint"}}, Runs: []Span{{at(7), at(10)}}},
+		{Target: Target{Name: "compile"}, Runs: []Span{{at(0), at(2)}}},
+		{Target: Target{Name: "lint"}, Runs: []Span{{at(0), at(3)}}},
+		{Target: Target{Name: "test", DependsOn: &[]string{"compile"}}, Runs: []Span{{at(2), at(4)}, {at(4), at(7)}}},
+		{Target: Target{Name: "cached"}, Status: StatusCached},
+	}
+	summary := Summarize(results, started, 10*time.Second)
+	if summary.Path() != "compile -> test -> deploy" {
+		t.Fatalf("Unexpected critical path %v", summary.Path())
+	}
+	if summary.Parallelism != 1.3 {
+		t.Fatalf("Expected a parallelism of 1.3, got %v", summary.Parallelism)
+	}
+	top := summary.TopTargets(2)
+	if len(top) != 2 || top[0].Target != "test" || top[0].Duration != 5*time.Second || top[1].Duration != 3*time.Second {
+		t.Fatalf("Unexpected top targets %v", top)
+	}
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// A Span is a period of time spent on a target
+type Span struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Duration of the span
+func (span Span) Duration() time.Duration {
+	return span.End.Sub(span.Start)
+}
+
+// traceEvent is an event of the Chrome Trace Event format, as read by chrome://tracing and Perfetto
+type traceEvent struct {
+	Name string                 `json:"name"`
+	Cat  string                 `json:"cat,omitempty"`
+	Ph   string                 `json:"ph"`
+	Ts   int64                  `json:"ts"`
+	Dur  int64                  `json:"dur,omitempty"`
+	Pid  int                    `json:"pid"`
+	Tid  int                    `json:"tid"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+// Processes of the trace, the slots the work of targets is done in, and the time targets wait on their dependencies
+const (
+	traceSlots   = 1
+	traceWaiting = 2
+)
+
+type traceSpan struct {
+	Span
+	target string
+	cat    string
+	args   map[string]interface{}
+}
+
+// WriteTrace writes the cache restores, attempts and cache uploads of the targets to file in the Chrome Trace Event format,
+// each in the first slot which is free at its start, so there is a lane per concurrent slot.
+// The waits of the targets on their dependencies are written to a lane per target.
+func WriteTrace(file string, plan string, started time.Time, results []TargetResult, uploads map[string]Span) error {
+	var spans []traceSpan
+	var waits []traceSpan
+	for _, result := range results {
+		name := result.Target.Name
+		if result.Restore != nil {
+			spans = append(spans, traceSpan{*result.Restore, name, "restore", map[string]interface{}{"source": result.CacheSource, "key": result.CacheKey}})
+		}
+		for i, run := range result.Runs {
+			args := map[string]interface{}{"attempt": i + 1}
+			if i == len(result.Runs)-1 {
+				args["status"] = result.Status
+				if result.ExitCode != nil {
+					args["exit_code"] = *result.ExitCode
+				}
+			}
+			spans = append(spans, traceSpan{run, name, "attempt", args})
+		}
+		if upload, uploaded := uploads[name]; uploaded {
+			spans = append(spans, traceSpan{upload, name, "upload", nil})
+		}
+		if !result.Scheduled.IsZero() && len(result.Runs) > 0 {
+			waits = append(waits, traceSpan{Span{result.Scheduled, result.Runs[0].Start}, name, "wait", nil})
+		}
+	}
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].Start.Before(spans[j].Start) })
+	sort.SliceStable(waits, func(i, j int) bool { return waits[i].target < waits[j].target })
+
+	events := []traceEvent{
+		{Name: "process_name", Ph: "M", Pid: traceSlots, Args: map[string]interface{}{"name": "gbuild " + plan}},
+		{Name: "process_name", Ph: "M", Pid: traceWaiting, Args: map[string]interface{}{"name": "waiting on dependencies"}},
+	}
+	var slots []time.Time
+	for _, span := range spans {
+		slot := -1
+		for i, end := range slots {
+			if !end.After(span.Start) {
+				slot = i
+				break
+			}
+		}
+		if slot < 0 {
+			slot = len(slots)
+			slots = append(slots, time.Time{})
+			events = append(events, traceEvent{Name: "thread_name", Ph: "M", Pid: traceSlots, Tid: slot + 1, Args: map[string]interface{}{"name": fmt.Sprintf("slot %v", slot+1)}})
+		}
+		slots[slot] = span.End
+		events = append(events, span.event(started, traceSlots, slot+1))
+	}
+	for i, wait := range waits {
+		events = append(events, traceEvent{Name: "thread_name", Ph: "M", Pid: traceWaiting, Tid: i + 1, Args: map[string]interface{}{"name": wait.target}})
+		events = append(events, wait.event(started, traceWaiting, i+1))
+	}
+
+	buf, err := json.Marshal(map[string]interface{}{"traceEvents": events, "displayTimeUnit": "ms"})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, buf, 0644)
+}
+
+func (span traceSpan) event(started time.Time, pid int, tid int) traceEvent {
+	return traceEvent{
+		Name: span.target,
+		Cat:  span.cat,
+		Ph:   "X",
+		Ts:   span.Start.Sub(started).Microseconds(),
+		Dur:  span.Duration().Microseconds(),
+		Pid:  pid,
+		Tid:  tid,
+		Args: span.args,
+	}
+}
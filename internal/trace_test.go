@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrace(t *testing.T) {
+	started := time.Now()
+	targets := []Target{
+		{Name: "a", Run: "sleep 0.2"},
+		{Name: "b", Run: "sleep 0.2"},
+		{Name: "c", Run: "cd .", DependsOn: &[]string{"a", "b"}},
+	}
+	results, err := RunPlan(targets, l)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "trace.json")
+	err = WriteTrace(file, "build", started, results, map[string]Span{"c": {time.Now(), time.Now().Add(time.Millisecond)}})
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+
+	buf, _ := ioutil.ReadFile(file)
+	trace := struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}{}
+	err = json.Unmarshal(buf, &trace)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	slots := map[int]bool{}
+	cats := map[string]int{}
+	for _, event := range trace.TraceEvents {
+		if event.Ph == "X" {
+			cats[event.Cat]++
+			if event.Pid == traceSlots {
+				slots[event.Tid] = true
+			}
+		}
+	}
+	if len(slots) != 2 {
+		t.Fatalf("Expected 2 concurrent slots, got %v", slots)
+	}
+	if cats["attempt"] != 3 || cats["wait"] != 3 || cats["upload"] != 1 {
+		t.Fatalf("Unexpected spans %v", cats)
+	}
+}
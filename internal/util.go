@@ -1,6 +1,10 @@
 package internal
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"strings"
+)
 
 // We provide a Log interface, so we can achieve two goals:
 // * Make sure our tests are not noisy
@@ -8,18 +12,44 @@ import "fmt"
 type Log interface {
 	Println(a ...interface{}) (n int, err error)
 	Printf(format string, a ...interface{}) (n int, err error)
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
 }
 
-type OSLog struct{}
+// OSLog logs to stdout, the zero value logging text at info level
+type OSLog struct {
+	Level Level
+	// text (default) or json
+	Format string
+	// Additional sink, such as a log file, which receives the same lines as stdout
+	File io.Writer
+}
 
 type NoLog struct{}
 
+// Println and Printf print as is in text format, and as info messages in json format
 func (log OSLog) Println(a ...interface{}) (n int, err error) {
-	return fmt.Println(a...)
+	if log.Format == LogJSON {
+		log.Info(strings.TrimSpace(fmt.Sprintln(a...)))
+		return 0, nil
+	}
+	if log.Level > LevelInfo {
+		return 0, nil
+	}
+	return log.write(fmt.Sprintln(a...))
 }
 
 func (log OSLog) Printf(format string, a ...interface{}) (n int, err error) {
-	return fmt.Printf(format, a...)
+	if log.Format == LogJSON {
+		log.Info(strings.TrimSpace(fmt.Sprintf(format, a...)))
+		return 0, nil
+	}
+	if log.Level > LevelInfo {
+		return 0, nil
+	}
+	return log.write(fmt.Sprintf(format, a...))
 }
 
 func (log NoLog) Println(a ...interface{}) (n int, err error) {
@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WatchOptions configures how targets are watched
+type WatchOptions struct {
+	RunOptions
+	// How often the inputs of the targets are checked for changes
+	Interval time.Duration
+	// How long the inputs must be unchanged, before the affected targets are run
+	Debounce time.Duration
+}
+
+// watchedFiles returns the files of a target to watch, the inputs of its caches if it declares any, or else its work dir
+func watchedFiles(target Target) []fileSet {
+	if target.Caches == nil || len(*target.Caches) == 0 {
+		return []fileSet{newFileSet(nil, target.WorkDir, []string{"."}, nil)}
+	}
+	var sets []fileSet
+	for _, cache := range *target.Caches {
+		sets = append(sets, newFileSet(nil, target.WorkDir, cache.Inputs, cache.Exclude))
+	}
+	return sets
+}
+
+// snapshot returns a digest of the names, sizes and modification times of the watched files of each target
+func snapshot(targets []Target) (map[string]uint64, error) {
+	gitIgnored, err := genShouldIgnoreFn(nil, true)
+	if err != nil {
+		return nil, err
+	}
+	// logs of the runs are written to .gbuild_cache, and must not trigger runs themselves
+	shouldIgnoreFn := func(file string) bool {
+		return strings.Contains(filepath.ToSlash(file), ".gbuild_cache/") || gitIgnored(file)
+	}
+	digests := map[string]uint64{}
+	for _, target := range targets {
+		hash := fnv.New64a()
+		for _, set := range watchedFiles(target) {
+			err := set.walk(shouldIgnoreFn, func(path string, rel string) error {
+				info, err := os.Stat(path)
+				if err != nil {
+					return nil
+				}
+				fmt.Fprintf(hash, "%v %v %v\n", path, info.Size(), info.ModTime().UnixNano())
+				return nil
+			})
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		digests[target.Name] = hash.Sum64()
+	}
+	return digests, nil
+}
+
+// affectedTargets returns the changed targets and the targets depending on them, directly or indirectly
+func affectedTargets(targets []Target, changed map[string]bool) map[string]bool {
+	affected := map[string]bool{}
+	for name := range changed {
+		affected[name] = true
+	}
+	for found := true; found; {
+		found = false
+		for _, target := range targets {
+			if affected[target.Name] || target.DependsOn == nil {
+				continue
+			}
+			for _, dependency := range *target.DependsOn {
+				if affected[dependency] {
+					affected[target.Name] = true
+					found = true
+					break
+				}
+			}
+		}
+	}
+	return affected
+}
+
+// withServices returns the targets to run along with the services they depend on, directly or through other services,
+// as a service is stopped at the end of each run, and has to be started again for its dependents
+func withServices(targets []Target, run map[string]bool) map[string]bool {
+	byName := map[string]Target{}
+	for _, target := range targets {
+		byName[target.Name] = target
+	}
+	selected := map[string]bool{}
+	var visit func(name string)
+	visit = func(name string) {
+		if selected[name] {
+			return
+		}
+		selected[name] = true
+		if dependsOn := byName[name].DependsOn; dependsOn != nil {
+			for _, dependency := range *dependsOn {
+				if byName[dependency].Service {
+					visit(dependency)
+				}
+			}
+		}
+	}
+	for name := range run {
+		visit(name)
+	}
+	return selected
+}
+
+// watchTargets returns the targets to run, along with the services they depend on. The other dependencies which are
+// not run again are satisfied by their last results, passing on their outputs
+func watchTargets(targets []Target, run map[string]bool, last map[string]TargetResult) []Target {
+	run = withServices(targets, run)
+	var results []TargetResult
+	for _, result := range last {
+		results = append(results, result)
+	}
+	var selected []Target
+	for _, target := range targets {
+		if !run[target.Name] {
+			continue
+		}
+		if target.DependsOn != nil {
+			var dependsOn []string
+			for _, dependency := range *target.DependsOn {
+				if run[dependency] {
+					dependsOn = append(dependsOn, dependency)
+				}
+			}
+			target.dependencyOutputs = dependencyEnv(target.dependencyOutputs, *target.DependsOn, results)
+			target.DependsOn = &dependsOn
+		}
+		selected = append(selected, target)
+	}
+	return selected
+}
+
+// A watchRun is a run of the targets affected by changes, of which targets can be cancelled when their inputs change again
+type watchRun struct {
+	lock      sync.Mutex
+	targets   map[string]bool
+	cancelled map[string]bool
+}
+
+func (run *watchRun) cancel(changed map[string]bool) []string {
+	run.lock.Lock()
+	defer run.lock.Unlock()
+	var cancelled []string
+	for name := range changed {
+		if run.targets[name] && !run.cancelled[name] {
+			run.cancelled[name] = true
+			cancelled = append(cancelled, name)
+		}
+	}
+	sort.Strings(cancelled)
+	return cancelled
+}
+
+func (run *watchRun) isCancelled(target string) bool {
+	run.lock.Lock()
+	defer run.lock.Unlock()
+	return run.cancelled[target]
+}
+
+// Watch runs the targets, and then watches their inputs, running the targets of which the inputs changed, and their dependents,
+// once no more changes are seen for the debounce time. Targets whose inputs change again while they run are cancelled, and run again.
+// Watch returns when stop is closed.
+func Watch(targets []Target, log Log, options WatchOptions, stop <-chan struct{}) error {
+	previous, err := snapshot(targets)
+	if err != nil {
+		return err
+	}
+	pending := map[string]bool{}
+	for _, target := range targets {
+		pending[target.Name] = true
+	}
+	last := map[string]TargetResult{}
+	var running *watchRun
+	done := make(chan []TargetResult)
+	var lastChange time.Time
+	ticker := time.NewTicker(options.Interval)
+	defer ticker.Stop()
+	for {
+		if running == nil && len(pending) > 0 && time.Since(lastChange) >= options.Debounce {
+			running = &watchRun{targets: pending, cancelled: map[string]bool{}}
+			runOptions := options.RunOptions
+			runOptions.Cancelled = running.isCancelled
+			selected := watchTargets(targets, pending, last)
+			pending = map[string]bool{}
+			go func() {
+				results, _ := RunPlanWithOptions(selected, log, runOptions)
+				done <- results
+			}()
+		}
+		select {
+		case <-stop:
+			if running != nil {
+				running.cancel(running.targets)
+				<-done
+			}
+			return nil
+		case results := <-done:
+			running = nil
+			failed := 0
+			for _, result := range results {
+				last[result.Target.Name] = result
+				if result.failed() {
+					failed++
+				}
+			}
+			if failed > 0 {
+				log.Error("Run failed, watching for changes", F("targets", len(results)), F("failed", failed))
+			} else {
+				log.Info("Run finished, watching for changes", F("targets", len(results)))
+			}
+		case <-ticker.C:
+			current, err := snapshot(targets)
+			if err != nil {
+				return err
+			}
+			changed := map[string]bool{}
+			for name, digest := range current {
+				if previous[name] != digest {
+					changed[name] = true
+				}
+			}
+			previous = current
+			if len(changed) == 0 {
+				continue
+			}
+			lastChange = time.Now()
+			affected := affectedTargets(targets, changed)
+			var names []string
+			for name := range affected {
+				pending[name] = true
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			log.Info("Inputs changed", F("targets", strings.Join(names, ",")))
+			if running != nil {
+				if cancelled := running.cancel(changed); len(cancelled) > 0 {
+					log.Warn("Cancelling targets whose inputs changed again", F("targets", strings.Join(cancelled, ",")))
+				}
+			}
+		}
+	}
+}
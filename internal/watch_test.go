@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAffectedTargets(t *testing.T) {
+	targets := []Target{
+		{Name: "a"},
+		{Name: "b", DependsOn: &[]string{"a"}},
+		{Name: "c", DependsOn: &[]string{"b"}},
+		{Name: "d"},
+	}
+	affected := affectedTargets(targets, map[string]bool{"a": true})
+	if len(affected) != 3 || !affected["a"] || !affected["b"] || !affected["c"] {
+		t.Fatalf("Expected a and its dependents to be affected, got %v", affected)
+	}
+}
+
+// watchFixture changes into a new directory with src and other dirs, returning a function to change back
+func watchFixture(t *testing.T) func() {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	os.Chdir(dir)
+	os.MkdirAll("src", os.ModePerm)
+	os.MkdirAll("other", os.ModePerm)
+	ioutil.WriteFile(filepath.Join("src", "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join("other", "b.txt"), []byte("b"), 0644)
+	return func() { os.Chdir(wd) }
+}
+
+// runs returns the number of lines written to the file, which the targets append a line to on each run
+func runs(file string) int {
+	buf, _ := ioutil.ReadFile(file)
+	return strings.Count(string(buf), "\n")
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out")
+		}
+	}
+}
+
+func TestWatchRunsAffectedTargets(t *testing.T) {
+	defer watchFixture(t)()
+	count := t.TempDir()
+	env := map[string]string{"COUNT": count}
+	targets := []Target{
+		{Name: "gen", Run: "echo run >> $COUNT/gen", Env: env, Caches: &[]Cache{{Inputs: []string{"src"}}}},
+		{Name: "use", Run: "echo run >> $COUNT/use", Env: env, DependsOn: &[]string{"gen"}, Caches: &[]Cache{{Inputs: []string{"other"}}}},
+	}
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- Watch(targets, l, WatchOptions{Interval: 20 * time.Millisecond, Debounce: 50 * time.Millisecond}, stop)
+	}()
+	gen, use := filepath.Join(count, "gen"), filepath.Join(count, "use")
+	waitFor(t, func() bool { return runs(gen) == 1 && runs(use) == 1 })
+
+	ioutil.WriteFile(filepath.Join("src", "a.txt"), []byte("changed"), 0644)
+	waitFor(t, func() bool { return runs(gen) == 2 && runs(use) == 2 })
+
+	ioutil.WriteFile(filepath.Join("other", "b.txt"), []byte("changed"), 0644)
+	waitFor(t, func() bool { return runs(use) == 3 })
+	if runs(gen) != 2 {
+		t.Fatalf("Expected gen not to run again, as its inputs did not change, got %v runs", runs(gen))
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+}
+
+func TestWatchCancelsTargetsWhoseInputsChangeAgain(t *testing.T) {
+	defer watchFixture(t)()
+	count := t.TempDir()
+	targets := []Target{
+		{Name: "slow", Run: "echo start >> $COUNT/slow; sleep 10", Env: map[string]string{"COUNT": count}, Caches: &[]Cache{{Inputs: []string{"src"}}}},
+	}
+	stop := make(chan struct{})
+	done := make(chan error)
+	start := time.Now()
+	go func() {
+		done <- Watch(targets, l, WatchOptions{Interval: 20 * time.Millisecond, Debounce: 50 * time.Millisecond}, stop)
+	}()
+	slow := filepath.Join(count, "slow")
+	waitFor(t, func() bool { return runs(slow) == 1 })
+
+	ioutil.WriteFile(filepath.Join("src", "a.txt"), []byte("changed"), 0644)
+	waitFor(t, func() bool { return runs(slow) == 2 })
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("Expected the running target to be cancelled")
+	}
+}
+
+func TestWatchStartsServicesAgainForTheirDependents(t *testing.T) {
+	defer watchFixture(t)()
+	os.MkdirAll("db", os.ModePerm)
+	dir := t.TempDir()
+	env := map[string]string{"DIR": dir}
+	targets := []Target{
+		{Name: "db", Service: true, WorkDir: String("db"), Run: "trap 'rm $DIR/ready; exit 0' TERM; echo run >> $DIR/db; touch $DIR/ready; while true; do sleep 0.1; done",
+			Env: env, ReadyCheck: &ReadyCheck{Command: String("test -f $DIR/ready"), Interval: String("50ms")}},
+		{Name: "use", Run: "test -f $DIR/ready && echo run >> $DIR/use", Env: env, DependsOn: &[]string{"db"}, Caches: &[]Cache{{Inputs: []string{"src"}}}},
+	}
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- Watch(targets, l, WatchOptions{Interval: 20 * time.Millisecond, Debounce: 50 * time.Millisecond}, stop)
+	}()
+	db, use := filepath.Join(dir, "db"), filepath.Join(dir, "use")
+	waitFor(t, func() bool { return runs(use) == 1 })
+
+	// only the inputs of use change, but the service it depends on was stopped after the first run
+	ioutil.WriteFile(filepath.Join("src", "a.txt"), []byte("changed"), 0644)
+	waitFor(t, func() bool { return runs(use) == 2 })
+	if runs(db) != 2 {
+		t.Fatalf("Expected db to be started again for use, got %v runs", runs(db))
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+}
@@ -0,0 +1,394 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// A whenExpr is a parsed when condition, which evaluates to a string or a bool
+type whenExpr interface {
+	eval(ctx *WhenContext, env map[string]string) (interface{}, error)
+}
+
+type whenLiteral struct{ value interface{} }
+
+type whenVar struct{ name string }
+
+type whenEnv struct{ name string }
+
+type whenNot struct{ expr whenExpr }
+
+type whenBinary struct {
+	op          string
+	left, right whenExpr
+}
+
+type whenChanged struct{ patterns []string }
+
+// whenVars are the variables of when conditions, besides env.NAME
+var whenVars = []string{"branch", "plan", "os", "arch"}
+
+// A WhenContext is what when conditions are evaluated against, besides the environment of each target
+type WhenContext struct {
+	Plan   string
+	Branch string
+	// Revision that changed files are compared to, along with the working tree
+	Since string
+	// Changed files, relative to the project root, looked up on first use
+	changed []string
+	loaded  bool
+	// Every file counts as changed, if the changed files could not be looked up
+	all bool
+	log Log
+}
+
+// NewWhenContext describes the checkout of the project for the plan, where the branch is that of the checkout,
+// or else of the CI system, as CI systems often check out a detached HEAD
+func NewWhenContext(plan string, since string, log Log) *WhenContext {
+	ctx := &WhenContext{Plan: plan, Since: since, log: log}
+	branch, err := GetGitBranch(nil)
+	if err != nil {
+		log.Debug("Could not read the git branch", F("error", err))
+	}
+	if branch != nil {
+		ctx.Branch = *branch
+		return ctx
+	}
+	for _, name := range []string{"GITHUB_HEAD_REF", "GITHUB_REF_NAME", "CI_COMMIT_BRANCH", "BRANCH_NAME", "GIT_BRANCH"} {
+		if value := os.Getenv(name); value != "" {
+			ctx.Branch = value
+			break
+		}
+	}
+	return ctx
+}
+
+// ConditionsUnmet returns the targets whose when condition is false
+func ConditionsUnmet(targets []Target, ctx *WhenContext) (map[string]bool, error) {
+	unmet := map[string]bool{}
+	for _, target := range targets {
+		if target.When == nil {
+			continue
+		}
+		met, err := evalWhen(*target.When, ctx, target.Env)
+		if err != nil {
+			return nil, fmt.Errorf("in the when condition of %v: %v", target.Name, err)
+		}
+		if !met {
+			unmet[target.Name] = true
+		}
+	}
+	return unmet, nil
+}
+
+func evalWhen(condition string, ctx *WhenContext, env map[string]string) (bool, error) {
+	expr, err := parseWhen(condition)
+	if err != nil {
+		return false, err
+	}
+	value, err := expr.eval(ctx, env)
+	if err != nil {
+		return false, err
+	}
+	return truthy(value), nil
+}
+
+// truthy is true for true, and for non-empty strings
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	default:
+		return false
+	}
+}
+
+func (e whenLiteral) eval(ctx *WhenContext, env map[string]string) (interface{}, error) {
+	return e.value, nil
+}
+
+func (e whenVar) eval(ctx *WhenContext, env map[string]string) (interface{}, error) {
+	switch e.name {
+	case "branch":
+		return ctx.Branch, nil
+	case "plan":
+		return ctx.Plan, nil
+	case "os":
+		return runtime.GOOS, nil
+	case "arch":
+		return runtime.GOARCH, nil
+	}
+	return nil, fmt.Errorf("unknown variable %v, must be one of branch, plan, os, arch or env.NAME", e.name)
+}
+
+func (e whenEnv) eval(ctx *WhenContext, env map[string]string) (interface{}, error) {
+	if value, hasKey := env[e.name]; hasKey {
+		return value, nil
+	}
+	return os.Getenv(e.name), nil
+}
+
+func (e whenNot) eval(ctx *WhenContext, env map[string]string) (interface{}, error) {
+	value, err := e.expr.eval(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(value), nil
+}
+
+func (e whenBinary) eval(ctx *WhenContext, env map[string]string) (interface{}, error) {
+	left, err := e.left.eval(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	// && and || short-circuit, so changed() is only looked up if needed
+	if e.op == "&&" && !truthy(left) {
+		return false, nil
+	}
+	if e.op == "||" && truthy(left) {
+		return true, nil
+	}
+	right, err := e.right.eval(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "==":
+		return fmt.Sprint(left) == fmt.Sprint(right), nil
+	case "!=":
+		return fmt.Sprint(left) != fmt.Sprint(right), nil
+	default:
+		return truthy(right), nil
+	}
+}
+
+func (e whenChanged) eval(ctx *WhenContext, env map[string]string) (interface{}, error) {
+	if !ctx.loaded {
+		changed, err := GetChangedFiles(nil, ctx.Since)
+		if err != nil {
+			ctx.log.Warn("Could not look up changed files, assuming every file changed", F("since", ctx.Since), F("error", err))
+			ctx.all = true
+		}
+		ctx.changed = changed
+		ctx.loaded = true
+	}
+	if ctx.all {
+		return true, nil
+	}
+	for _, file := range ctx.changed {
+		for _, pattern := range e.patterns {
+			if newFileSetEntry(pattern).matches(file) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// whenParser parses conditions such as branch == "main" && changed("infra/**"), where && binds tighter than ||
+type whenParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseWhen(condition string) (whenExpr, error) {
+	tokens, err := tokenizeWhen(condition)
+	if err != nil {
+		return nil, err
+	}
+	p := &whenParser{tokens: tokens}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %v", p.tokens[p.pos])
+	}
+	return expr, nil
+}
+
+func (p *whenParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *whenParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *whenParser) expect(token string) error {
+	if next := p.next(); next != token {
+		if next == "" {
+			next = "end of condition"
+		}
+		return fmt.Errorf("expected %v, got %v", token, next)
+	}
+	return nil
+}
+
+func (p *whenParser) or() (whenExpr, error) {
+	left, err := p.and()
+	for err == nil && p.peek() == "||" {
+		p.next()
+		var right whenExpr
+		right, err = p.and()
+		left = whenBinary{"||", left, right}
+	}
+	return left, err
+}
+
+func (p *whenParser) and() (whenExpr, error) {
+	left, err := p.unary()
+	for err == nil && p.peek() == "&&" {
+		p.next()
+		var right whenExpr
+		right, err = p.unary()
+		left = whenBinary{"&&", left, right}
+	}
+	return left, err
+}
+
+func (p *whenParser) unary() (whenExpr, error) {
+	if p.peek() == "!" {
+		p.next()
+		expr, err := p.unary()
+		return whenNot{expr}, err
+	}
+	left, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if op := p.peek(); op == "==" || op == "!=" {
+		p.next()
+		right, err := p.primary()
+		return whenBinary{op, left, right}, err
+	}
+	return left, nil
+}
+
+func (p *whenParser) primary() (whenExpr, error) {
+	token := p.next()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of condition")
+	case token == "(":
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+	case token[0] == '"' || token[0] == '\'':
+		return whenLiteral{token[1 : len(token)-1]}, nil
+	case token == "true" || token == "false":
+		return whenLiteral{token == "true"}, nil
+	case token == "changed":
+		return p.changed()
+	case strings.HasPrefix(token, "env."):
+		return whenEnv{strings.TrimPrefix(token, "env.")}, nil
+	case isIdentStart(rune(token[0])):
+		// unknown variables are rejected when the config is loaded, rather than once a condition reaches them
+		if !containsString(token, whenVars) {
+			return nil, fmt.Errorf("unknown variable %v, must be one of branch, plan, os, arch or env.NAME", token)
+		}
+		return whenVar{token}, nil
+	}
+	return nil, fmt.Errorf("unexpected %v", token)
+}
+
+// changed parses the arguments of changed("glob", ...), which are doublestar globs relative to the project root
+func (p *whenParser) changed() (whenExpr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for {
+		token := p.next()
+		if token == "" || (token[0] != '"' && token[0] != '\'') {
+			return nil, fmt.Errorf("changed expects quoted globs")
+		}
+		pattern := token[1 : len(token)-1]
+		if !doublestar.ValidatePattern(pattern) {
+			return nil, fmt.Errorf("invalid glob %q", pattern)
+		}
+		patterns = append(patterns, pattern)
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	return whenChanged{patterns}, p.expect(")")
+}
+
+func isIdentStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_'
+}
+
+// tokenizeWhen splits a condition into operators, parentheses, commas, identifiers and quoted strings,
+// where double quoted strings are unquoted as Go strings
+func tokenizeWhen(condition string) ([]string, error) {
+	var tokens []string
+	runes := []rune(condition)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == ',':
+			tokens = append(tokens, string(r))
+			i++
+		case r == '!' && i+1 < len(runes) && runes[i+1] == '=':
+			tokens = append(tokens, "!=")
+			i += 2
+		case r == '!':
+			tokens = append(tokens, "!")
+			i++
+		case i+1 < len(runes) && (string(runes[i:i+2]) == "==" || string(runes[i:i+2]) == "&&" || string(runes[i:i+2]) == "||"):
+			tokens = append(tokens, string(runes[i:i+2]))
+			i += 2
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				if runes[end] == '\\' && r == '"' {
+					end++
+				}
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated string %v", string(runes[i:]))
+			}
+			s := string(runes[i+1 : end])
+			if r == '"' {
+				unquoted, err := strconv.Unquote(string(runes[i : end+1]))
+				if err != nil {
+					return nil, fmt.Errorf("invalid string %v: %v", string(runes[i:end+1]), err)
+				}
+				s = unquoted
+			}
+			// strings keep a leading quote, to tell them apart from identifiers
+			tokens = append(tokens, "'"+s+"'")
+			i = end + 1
+		case isIdentStart(r):
+			end := i
+			for end < len(runes) && (isIdentStart(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, string(runes[i:end]))
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected character %q", r)
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestWhen(t *testing.T) {
+	ctx := &WhenContext{Plan: "build", Branch: "main", changed: []string{"infra/main.tf", "README.md"}, loaded: true, log: NoLog{}}
+	env := map[string]string{"DEPLOY": "true", "EMPTY": ""}
+	conditions := map[string]bool{
+		`branch == "main"`:                             true,
+		`branch != 'main'`:                             false,
+		`branch == "main" && changed("infra/**")`:      true,
+		`changed("web/**")`:                            false,
+		`changed("web/**", "*.md")`:                    true,
+		`changed("infra")`:                             true,
+		`env.DEPLOY == "true"`:                         true,
+		`env.DEPLOY`:                                   true,
+		`env.EMPTY || env.GBUILD_UNSET_VARIABLE`:       false,
+		`!(branch == "dev" || plan == "release")`:      true,
+		`false || branch == "main" && !true`:           false,
+		`"a \"quoted\" string" == 'a "quoted" string'`: true,
+	}
+	conditions[`plan == "build" && os == "`+runtime.GOOS+`"`] = true
+	for condition, expected := range conditions {
+		met, err := evalWhen(condition, ctx, env)
+		if err != nil {
+			t.Fatalf("Did not expect error %v for %v", err, condition)
+		}
+		if met != expected {
+			t.Fatalf("Expected %v to be %v", condition, expected)
+		}
+	}
+
+	for _, condition := range []string{`branch ==`, `(branch == "main"`, `changed(infra)`, `branch = "main"`, `"unterminated`, `branch "main"`, `tag == "v1"`,
+		`branch == "main" || tag == "v1"`} {
+		if _, err := evalWhen(condition, ctx, env); err == nil {
+			t.Fatalf("Expected an error for %v but got none", condition)
+		}
+	}
+}
+
+func TestConditionsUnmet(t *testing.T) {
+	ctx := &WhenContext{Plan: "build", Branch: "feature", loaded: true, log: NoLog{}}
+	targets := []Target{
+		{Name: "test"},
+		{Name: "deploy", When: String(`branch == "main"`)},
+		{Name: "lint", When: String(`branch != "main"`)},
+	}
+	unmet, err := ConditionsUnmet(targets, ctx)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if len(unmet) != 1 || !unmet["deploy"] {
+		t.Fatalf("Expected only deploy to be unmet, got %v", unmet)
+	}
+}
@@ -1,12 +1,60 @@
 package api
 
 import (
+	"bytes"
+	"encoding/json"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 type CacheIndex struct {
 	Hashes    map[string]string
 	GitHashes map[string]string
+	// Entries describes each cache entry, keyed by its output hash
+	Entries map[string]CacheEntry
+	// Signatures of the Hashes and GitHashes entries, keyed like them
+	Signatures map[string]string
+}
+
+type CacheEntry struct {
+	Target  string
+	Inputs  []string
+	Size    int64
+	Created time.Time
+	Hits    int
+	LastHit *time.Time
+	// SHA-256 of the stored zip archive or manifest, and its signature if signing is configured
+	Digest    string
+	Signature string
+	// Values the target wrote to $GBUILD_OUTPUT, passed on to its dependents when it is restored
+	Outputs map[string]string
+	// Format of the stored entry, empty for entries stored before it was recorded
+	Format string
+}
+
+// lastUsed is when the entry was last hit, or else created, and the zero time if the index records neither
+func (entry CacheEntry) lastUsed() time.Time {
+	if entry.LastHit != nil {
+		return *entry.LastHit
+	}
+	return entry.Created
+}
+
+// Formats of stored cache entries
+const (
+	FormatZip      = "zip"
+	FormatManifest = "manifest"
+)
+
+// A Manifest maps each output file, relative to the work dir of its target,
+// to the content hash of the blob holding its contents.
+type Manifest struct {
+	Files map[string]string
+	// Hash algorithm of the blobs, md5 if empty
+	Algorithm string
 }
 
 // Probably change this interface
@@ -17,22 +65,180 @@ type CacheProvider interface {
 	PutCache(string, io.Reader) error
 }
 
+// BlobProvider is implemented by cache providers that support content-addressed
+// storage, where each output file is stored once by its content hash.
+type BlobProvider interface {
+	HasBlob(string) (bool, error)
+	GetBlob(string) (*io.Reader, error)
+	PutBlob(string, io.Reader) error
+}
+
+// CacheRemover is implemented by cache providers that can delete a cache entry
+type CacheRemover interface {
+	RemoveCache(string) error
+}
+
 type LocalFileCacheProvider struct {
 	Directory string
 }
 
+func (cache *LocalFileCacheProvider) indexFile() string {
+	return filepath.Join(cache.Directory, "index.json")
+}
+
 func (cache *LocalFileCacheProvider) GetIndex() (*CacheIndex, error) {
-	return nil, nil
+	index := &CacheIndex{map[string]string{}, map[string]string{}, map[string]CacheEntry{}, map[string]string{}}
+	buf, err := ioutil.ReadFile(cache.indexFile())
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(buf, index)
+	if err != nil {
+		return nil, err
+	}
+	if index.Hashes == nil {
+		index.Hashes = map[string]string{}
+	}
+	if index.GitHashes == nil {
+		index.GitHashes = map[string]string{}
+	}
+	if index.Entries == nil {
+		index.Entries = map[string]CacheEntry{}
+	}
+	if index.Signatures == nil {
+		index.Signatures = map[string]string{}
+	}
+	return index, nil
 }
 
+// PutIndex writes the index, merged with the one on disk, so entries other builds sharing the cache directory
+// stored since it was read are kept. Entries only on disk are dropped if their stored entry was removed.
 func (cache *LocalFileCacheProvider) PutIndex(index CacheIndex) error {
-	return nil
+	stored, err := cache.GetIndex()
+	if err != nil {
+		return err
+	}
+	merged := cache.merge(index, *stored)
+	buf, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	return writeFile(cache.indexFile(), bytes.NewReader(buf))
+}
+
+// merge adds the entries of the stored index missing from the index, of which the stored entry still exists,
+// and keeps the most hits of entries in both
+func (cache *LocalFileCacheProvider) merge(index CacheIndex, stored CacheIndex) CacheIndex {
+	exists := func(hash string) bool {
+		_, err := os.Stat(filepath.Join(cache.Directory, "cache", hash))
+		return err == nil
+	}
+	merged := CacheIndex{map[string]string{}, map[string]string{}, map[string]CacheEntry{}, map[string]string{}}
+	for _, maps := range [][2]map[string]string{{merged.Hashes, index.Hashes}, {merged.GitHashes, index.GitHashes},
+		{merged.Signatures, index.Signatures}} {
+		for key, value := range maps[1] {
+			maps[0][key] = value
+		}
+	}
+	for hash, entry := range index.Entries {
+		merged.Entries[hash] = entry
+	}
+	for _, maps := range [][2]map[string]string{{merged.Hashes, stored.Hashes}, {merged.GitHashes, stored.GitHashes}} {
+		for key, hash := range maps[1] {
+			if _, found := maps[0][key]; !found && exists(hash) {
+				maps[0][key] = hash
+				if signature, signed := stored.Signatures[key]; signed {
+					merged.Signatures[key] = signature
+				}
+			}
+		}
+	}
+	for hash, entry := range stored.Entries {
+		current, found := merged.Entries[hash]
+		if !found {
+			if exists(hash) {
+				merged.Entries[hash] = entry
+			}
+			continue
+		}
+		if entry.Hits > current.Hits {
+			current.Hits = entry.Hits
+		}
+		if entry.LastHit != nil && (current.LastHit == nil || entry.LastHit.After(*current.LastHit)) {
+			current.LastHit = entry.LastHit
+		}
+		merged.Entries[hash] = current
+	}
+	return merged
 }
 
 func (cache *LocalFileCacheProvider) GetCache(hash string) (*io.Reader, error) {
-	return nil, nil
+	return readFile(filepath.Join(cache.Directory, "cache", hash))
 }
 
 func (cache *LocalFileCacheProvider) PutCache(hash string, reader io.Reader) error {
-	return nil
+	return writeFile(filepath.Join(cache.Directory, "cache", hash), reader)
+}
+
+// RemoveCache removes a cache entry, its blobs are removed by the next garbage collection if unreferenced
+func (cache *LocalFileCacheProvider) RemoveCache(hash string) error {
+	err := os.Remove(filepath.Join(cache.Directory, "cache", hash))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (cache *LocalFileCacheProvider) HasBlob(hash string) (bool, error) {
+	_, err := os.Stat(filepath.Join(cache.Directory, "blobs", hash))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (cache *LocalFileCacheProvider) GetBlob(hash string) (*io.Reader, error) {
+	return readFile(filepath.Join(cache.Directory, "blobs", hash))
+}
+
+func (cache *LocalFileCacheProvider) PutBlob(hash string, reader io.Reader) error {
+	return writeFile(filepath.Join(cache.Directory, "blobs", hash), reader)
+}
+
+func readFile(path string) (*io.Reader, error) {
+	// read fully, so callers don't need to close anything
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	touch(path)
+	var reader io.Reader = bytes.NewReader(buf)
+	return &reader, nil
+}
+
+func writeFile(path string, reader io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so a partial write never looks like a complete entry.
+	// Its name is unique, as builds sharing the cache directory may write the same file at once.
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	_, err = io.Copy(file, reader)
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
 }
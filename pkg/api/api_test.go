@@ -1,11 +1,113 @@
 package api
 
-import "testing"
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
 
 func TestGetPutIndex(t *testing.T) {
+	cache := &LocalFileCacheProvider{t.TempDir()}
 
+	index, err := cache.GetIndex()
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if len(index.Hashes) != 0 || len(index.GitHashes) != 0 {
+		t.Fatalf("Expected empty index, got %v", index)
+	}
+
+	index.Hashes["in"] = "out"
+	err = cache.PutIndex(*index)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+
+	index, err = cache.GetIndex()
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if index.Hashes["in"] != "out" {
+		t.Fatalf("Expected index to contain written hash, got %v", index)
+	}
+}
+
+func TestPutIndexKeepsEntriesStoredSinceItWasRead(t *testing.T) {
+	cache := &LocalFileCacheProvider{t.TempDir()}
+	cache.PutCache("removed", strings.NewReader("r"))
+	cache.PutIndex(CacheIndex{map[string]string{"in0": "removed"}, map[string]string{}, map[string]CacheEntry{"removed": {Hits: 1}}, map[string]string{}})
+	stale, _ := cache.GetIndex()
+
+	// another build stores an entry, and the one read before is removed
+	cache.PutCache("other", strings.NewReader("o"))
+	other, _ := cache.GetIndex()
+	other.Hashes["in2"] = "other"
+	other.Signatures["in2"] = "signature"
+	other.Entries["other"] = CacheEntry{Hits: 3}
+	cache.PutIndex(*other)
+	cache.RemoveCache("removed")
+
+	stale.Hashes["in1"] = "out"
+	delete(stale.Hashes, "in0")
+	delete(stale.Entries, "removed")
+	stale.Entries["other"] = CacheEntry{Hits: 1}
+	err := cache.PutIndex(*stale)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	index, _ := cache.GetIndex()
+	if index.Hashes["in1"] != "out" || index.Hashes["in2"] != "other" || index.Signatures["in2"] != "signature" || index.Entries["other"].Hits != 3 {
+		t.Fatalf("Expected the entry stored since the index was read to be kept, got %v", index)
+	}
+	if _, found := index.Hashes["in0"]; found {
+		t.Fatalf("Expected the removed entry to stay removed, got %v", index)
+	}
 }
 
 func TestGetPutCache(t *testing.T) {
+	cache := &LocalFileCacheProvider{t.TempDir()}
+
+	_, err := cache.GetCache("foo")
+	if err == nil {
+		t.Fatal("Expected error for missing cache entry")
+	}
+
+	err = cache.PutCache("foo", strings.NewReader("bar"))
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	reader, err := cache.GetCache("foo")
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	buf, _ := ioutil.ReadAll(*reader)
+	if string(buf) != "bar" {
+		t.Fatalf("Expected bar, got %v", string(buf))
+	}
+}
+
+func TestHasGetPutBlob(t *testing.T) {
+	cache := &LocalFileCacheProvider{t.TempDir()}
+
+	hasBlob, err := cache.HasBlob("foo")
+	if err != nil || hasBlob {
+		t.Fatalf("Expected no blob and no error, got %v, %v", hasBlob, err)
+	}
 
+	err = cache.PutBlob("foo", strings.NewReader("bar"))
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	hasBlob, err = cache.HasBlob("foo")
+	if err != nil || !hasBlob {
+		t.Fatalf("Expected blob and no error, got %v, %v", hasBlob, err)
+	}
+	reader, err := cache.GetBlob("foo")
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	buf, _ := ioutil.ReadAll(*reader)
+	if string(buf) != "bar" {
+		t.Fatalf("Expected bar, got %v", string(buf))
+	}
 }
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// blobGracePeriod is how old a blob must be, before it is swept when no manifest references it.
+// The blobs of an entry are stored before its manifest, so a recent one may belong to an entry being stored.
+const blobGracePeriod = time.Hour
+
+type GCResult struct {
+	Removed    int
+	FreedBytes int64
+}
+
+// GarbageCollector is implemented by cache providers that can evict their least recently used entries.
+// A maxSize or maxAge of 0 means no limit.
+type GarbageCollector interface {
+	CollectGarbage(maxSize int64, maxAge time.Duration) (*GCResult, error)
+}
+
+type cacheEntry struct {
+	hash       string
+	size       int64
+	lastAccess time.Time
+	blobs      []string
+}
+
+// touch marks a file as accessed now, which is what LRU eviction is based upon
+func touch(path string) {
+	now := time.Now()
+	os.Chtimes(path, now, now)
+}
+
+func (cache *LocalFileCacheProvider) CollectGarbage(maxSize int64, maxAge time.Duration) (*GCResult, error) {
+	result := &GCResult{}
+	entries, err := cache.entries()
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := blobFiles(filepath.Join(cache.Directory, "blobs"))
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]int{}
+	total := int64(0)
+	for _, entry := range entries {
+		total += entry.size
+		for _, blob := range entry.blobs {
+			if refs[blob] == 0 && blobs[blob] != nil {
+				total += blobs[blob].Size()
+			}
+			refs[blob]++
+		}
+	}
+
+	// entries are sorted least recently used first
+	removed := map[string]bool{}
+	released := map[string]bool{}
+	for _, entry := range entries {
+		expired := maxAge > 0 && time.Since(entry.lastAccess) > maxAge
+		if !expired && (maxSize <= 0 || total <= maxSize) {
+			break
+		}
+		err = os.Remove(filepath.Join(cache.Directory, "cache", entry.hash))
+		if err != nil {
+			return nil, err
+		}
+		removed[entry.hash] = true
+		total -= entry.size
+		result.Removed++
+		result.FreedBytes += entry.size
+		for _, blob := range entry.blobs {
+			refs[blob]--
+			if refs[blob] == 0 && blobs[blob] != nil {
+				total -= blobs[blob].Size()
+				released[blob] = true
+			}
+		}
+	}
+
+	// sweep blobs of removed entries, and blobs no manifest references once they are older than the grace period
+	for blob, info := range blobs {
+		if refs[blob] > 0 || (!released[blob] && time.Since(info.ModTime()) < blobGracePeriod) {
+			continue
+		}
+		err = os.Remove(filepath.Join(cache.Directory, "blobs", blob))
+		if err != nil {
+			return nil, err
+		}
+		result.Removed++
+		result.FreedBytes += info.Size()
+	}
+
+	if len(removed) > 0 {
+		err = cache.removeFromIndex(removed)
+	}
+	return result, err
+}
+
+// entries lists the cache entries, least recently used first. Only manifests are read, for the blobs they reference,
+// zip archives reference none.
+func (cache *LocalFileCacheProvider) entries() ([]cacheEntry, error) {
+	dir := filepath.Join(cache.Directory, "cache")
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	index, err := cache.GetIndex()
+	if err != nil {
+		return nil, err
+	}
+	var entries []cacheEntry
+	for _, file := range files {
+		if file.IsDir() || strings.HasSuffix(file.Name(), ".tmp") {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		indexed := index.Entries[file.Name()]
+		// hits restored from the workspace or the local working cache never read the stored entry,
+		// so the index, which records every hit, is what tells when it was last used
+		entry := cacheEntry{file.Name(), file.Size(), indexed.lastUsed(), nil}
+		if entry.lastAccess.IsZero() {
+			entry.lastAccess = file.ModTime()
+		}
+		manifest := indexed.Format == FormatManifest
+		if indexed.Format == "" {
+			manifest, err = isManifest(path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if manifest {
+			entry.blobs, err = manifestBlobs(path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastAccess.Before(entries[j].lastAccess)
+	})
+	return entries, nil
+}
+
+// isManifest tells a manifest from a zip archive by its first byte, for entries stored before their format was recorded
+func isManifest(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(file, buf)
+	if err == io.EOF {
+		return false, nil
+	}
+	return buf[0] == '{', err
+}
+
+// manifestBlobs returns the blobs referenced by the manifest
+func manifestBlobs(path string) ([]string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := Manifest{}
+	err = json.Unmarshal(buf, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	var blobs []string
+	for _, blob := range manifest.Files {
+		blobs = append(blobs, blob)
+	}
+	return blobs, nil
+}
+
+func (cache *LocalFileCacheProvider) removeFromIndex(removed map[string]bool) error {
+	index, err := cache.GetIndex()
+	if err != nil {
+		return err
+	}
+	for key, hash := range index.Hashes {
+		if removed[hash] {
+			delete(index.Hashes, key)
+			delete(index.Signatures, key)
+		}
+	}
+	for key, hash := range index.GitHashes {
+		if removed[hash] {
+			delete(index.GitHashes, key)
+			delete(index.Signatures, key)
+		}
+	}
+	for hash := range removed {
+		delete(index.Entries, hash)
+	}
+	return cache.PutIndex(*index)
+}
+
+// blobFiles returns the stored blobs by name, leaving out those still being written
+func blobFiles(dir string) (map[string]os.FileInfo, error) {
+	blobs := map[string]os.FileInfo{}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return blobs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() && !strings.HasSuffix(file.Name(), ".tmp") {
+			blobs[file.Name()] = file
+		}
+	}
+	return blobs, nil
+}
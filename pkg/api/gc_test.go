@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func putManifest(t *testing.T, cache *LocalFileCacheProvider, hash string, blobs map[string]string) {
+	for blob, content := range blobs {
+		cache.PutBlob(blob, strings.NewReader(content))
+	}
+	files := map[string]string{}
+	for blob := range blobs {
+		files["out/"+blob] = blob
+	}
+	buf, _ := json.Marshal(Manifest{Files: files})
+	err := cache.PutCache(hash, strings.NewReader(string(buf)))
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+}
+
+func TestCollectGarbageByAge(t *testing.T) {
+	cache := &LocalFileCacheProvider{t.TempDir()}
+	putManifest(t, cache, "old", map[string]string{"a": "aaaa", "shared": "ssss"})
+	putManifest(t, cache, "new", map[string]string{"b": "bbbb", "shared": "ssss"})
+	cache.PutIndex(CacheIndex{map[string]string{"in1": "old", "in2": "new"}, map[string]string{"rev": "old"}, map[string]CacheEntry{"old": {}}, map[string]string{}})
+	lastMonth := time.Now().Add(-30 * 24 * time.Hour)
+	os.Chtimes(filepath.Join(cache.Directory, "cache", "old"), lastMonth, lastMonth)
+
+	res, err := cache.CollectGarbage(0, 14*24*time.Hour)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	// the old manifest and the blob only it referenced
+	if res.Removed != 2 {
+		t.Fatalf("Expected 2 removals, got %v", res)
+	}
+	for _, blob := range []string{"b", "shared"} {
+		if hasBlob, _ := cache.HasBlob(blob); !hasBlob {
+			t.Fatalf("Expected blob %v to be kept", blob)
+		}
+	}
+	index, _ := cache.GetIndex()
+	if len(index.Hashes) != 1 || len(index.GitHashes) != 0 || len(index.Entries) != 0 {
+		t.Fatalf("Expected index entries of removed entry to be removed, got %v", index)
+	}
+}
+
+func TestCollectGarbageBySize(t *testing.T) {
+	cache := &LocalFileCacheProvider{t.TempDir()}
+	putManifest(t, cache, "first", map[string]string{"a": strings.Repeat("a", 1000)})
+	putManifest(t, cache, "second", map[string]string{"b": strings.Repeat("b", 1000)})
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+	os.Chtimes(filepath.Join(cache.Directory, "cache", "first"), lastWeek, lastWeek)
+
+	_, err := cache.CollectGarbage(1500, 0)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if hasBlob, _ := cache.HasBlob("a"); hasBlob {
+		t.Fatal("Expected blob of least recently used entry to be removed")
+	}
+	if _, err := cache.GetCache("second"); err != nil {
+		t.Fatalf("Expected most recently used entry to be kept, got %v", err)
+	}
+}
+
+func TestCollectGarbageKeepsBlobsOfManifests(t *testing.T) {
+	cache := &LocalFileCacheProvider{t.TempDir()}
+	putManifest(t, cache, "indexed", map[string]string{"a": "aaaa"})
+	putManifest(t, cache, "legacy", map[string]string{"b": "bbbb"})
+	cache.PutCache("archive", strings.NewReader("PK\x03\x04"))
+	cache.PutIndex(CacheIndex{map[string]string{}, map[string]string{},
+		map[string]CacheEntry{"indexed": {Format: FormatManifest}, "archive": {Format: FormatZip}}, map[string]string{}})
+
+	res, err := cache.CollectGarbage(0, 14*24*time.Hour)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if res.Removed != 0 {
+		t.Fatalf("Expected nothing to be removed, got %v", res)
+	}
+	for _, blob := range []string{"a", "b"} {
+		if hasBlob, _ := cache.HasBlob(blob); !hasBlob {
+			t.Fatalf("Expected blob %v to be kept", blob)
+		}
+	}
+}
+
+func TestCollectGarbageByLastHit(t *testing.T) {
+	cache := &LocalFileCacheProvider{t.TempDir()}
+	putManifest(t, cache, "hit", map[string]string{"a": "aaaa"})
+	putManifest(t, cache, "unused", map[string]string{"b": "bbbb"})
+	lastMonth := time.Now().Add(-30 * 24 * time.Hour)
+	yesterday := time.Now().Add(-24 * time.Hour)
+	// hits from the workspace or the local working cache do not read the stored entry, so its mtime is stale
+	os.Chtimes(filepath.Join(cache.Directory, "cache", "hit"), lastMonth, lastMonth)
+	cache.PutIndex(CacheIndex{map[string]string{"in1": "hit", "in2": "unused"}, map[string]string{},
+		map[string]CacheEntry{"hit": {Created: lastMonth, LastHit: &yesterday}, "unused": {Created: lastMonth}}, map[string]string{}})
+
+	_, err := cache.CollectGarbage(0, 14*24*time.Hour)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if _, err := cache.GetCache("hit"); err != nil {
+		t.Fatalf("Expected recently hit entry to be kept, got %v", err)
+	}
+	if _, err := cache.GetCache("unused"); err == nil {
+		t.Fatal("Expected entry which was not hit since last month to be removed")
+	}
+}
+
+func TestCollectGarbageKeepsBlobsBeingStored(t *testing.T) {
+	cache := &LocalFileCacheProvider{t.TempDir()}
+	// blobs of an entry whose manifest is not written yet, one of them still being written
+	cache.PutBlob("recent", strings.NewReader("rrrr"))
+	cache.PutBlob("orphan", strings.NewReader("oooo"))
+	ioutil.WriteFile(filepath.Join(cache.Directory, "blobs", "partial.tmp"), []byte("pppp"), 0644)
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+	os.Chtimes(filepath.Join(cache.Directory, "blobs", "orphan"), lastWeek, lastWeek)
+	os.Chtimes(filepath.Join(cache.Directory, "blobs", "partial.tmp"), lastWeek, lastWeek)
+
+	res, err := cache.CollectGarbage(0, 14*24*time.Hour)
+	if err != nil {
+		t.Fatalf("Did not expect error %v", err)
+	}
+	if res.Removed != 1 {
+		t.Fatalf("Expected only the old orphaned blob to be removed, got %v", res)
+	}
+	if hasBlob, _ := cache.HasBlob("recent"); !hasBlob {
+		t.Fatal("Expected recent blob to be kept")
+	}
+	if _, err := os.Stat(filepath.Join(cache.Directory, "blobs", "partial.tmp")); err != nil {
+		t.Fatalf("Expected blob being written to be kept, got %v", err)
+	}
+}